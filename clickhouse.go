@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// config
+// {
+// "URL":"http://127.0.0.1:8123",
+// "Database":"default",
+// "Table":"nginxlog",
+// "UserName":"default",
+// "Password":"",
+// "CreateTable":"true",
+// "OrderBy":"timestamp",
+// "PartitionBy":"toYYYYMMDD(timestamp)",
+// "BatchSize":"10000",
+// "FlushInterval":"5000",
+// "MaxRetry":"3",
+// "Timeout":"30000",
+// "Type":"clickhouse"
+// }
+// CreateTable create MergeTree table from LogParser schema
+// int: Int64, float: Float64, nginxtimestamp and timestamp: DateTime64(3), others: String
+
+// ClickHouseWriter clickhouse http writer
+type ClickHouseWriter struct {
+	endpoint      string
+	Database      string
+	Table         string
+	UserName      string
+	Password      string
+	BatchSize     int
+	FlushInterval int
+	guard         *SinkGuard
+	client        *http.Client
+	wg            sinkWaitGroup
+	exitChan      chan int
+	metricstatus  *prometheus.CounterVec
+}
+
+// NewClickHouseWriter create ClickHouseWriter
+func NewClickHouseWriter(config map[string]string, parser *LogParser) (*ClickHouseWriter, error) {
+	w := &ClickHouseWriter{
+		endpoint: strings.TrimRight(config["URL"], "/") + "/",
+		Database: config["Database"],
+		Table:    config["Table"],
+		UserName: config["UserName"],
+		Password: config["Password"],
+	}
+	if len(w.Table) == 0 {
+		return w, fmt.Errorf("no clickhouse table")
+	}
+	if len(w.Database) == 0 {
+		w.Database = "default"
+	}
+	var err error
+	w.BatchSize, err = strconv.Atoi(config["BatchSize"])
+	if err != nil || w.BatchSize < 1 {
+		w.BatchSize = 10000
+	}
+	w.FlushInterval, err = strconv.Atoi(config["FlushInterval"])
+	if err != nil || w.FlushInterval < 100 {
+		w.FlushInterval = 5000
+	}
+	timeout, err := strconv.Atoi(config["Timeout"])
+	if err != nil || timeout < 1000 {
+		timeout = 30000
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if strings.HasPrefix(w.endpoint, "https") {
+		transport.TLSClientConfig, err = NewTLSConfig(config)
+		if err != nil {
+			return w, err
+		}
+	}
+	w.client = &http.Client{Transport: transport, Timeout: time.Duration(timeout) * time.Millisecond}
+	if config["CreateTable"] == "true" {
+		if parser == nil {
+			return w, fmt.Errorf("no LogParser to create table")
+		}
+		if err := w.createTable(parser.Schema(), config["OrderBy"], config["PartitionBy"]); err != nil {
+			return w, err
+		}
+	}
+	w.exitChan = make(chan int)
+	w.metricstatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "lazy_output",
+			Name:      fmt.Sprintf("clickhouse_writer_%s", config["Taskname"]),
+			Help:      "clickhouse writer status.",
+		},
+		[]string{"method"},
+	)
+	// Register status
+	prometheus.Register(w.metricstatus)
+	w.guard = NewSinkGuard("clickhouse", guardConfig(config, map[string]string{"RetryBackoff": "1000"}))
+	return w, nil
+}
+
+func clickHouseType(format string) string {
+	switch format {
+	case "int":
+		return "Int64"
+	case "float":
+		return "Float64"
+	case "nginxtimestamp", "time":
+		return "DateTime64(3)"
+	default:
+		return "String"
+	}
+}
+
+func (w *ClickHouseWriter) createTable(schema map[string]string, orderBy, partitionBy string) error {
+	if len(orderBy) == 0 {
+		orderBy = "timestamp"
+	}
+	if len(partitionBy) == 0 {
+		partitionBy = "toYYYYMMDD(timestamp)"
+	}
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	columns := make([]string, 0, len(names))
+	for _, name := range names {
+		columns = append(columns, fmt.Sprintf("`%s` %s", name, clickHouseType(schema[name])))
+	}
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s`.`%s` (%s) ENGINE = MergeTree() PARTITION BY %s ORDER BY (%s)",
+		w.Database, w.Table, strings.Join(columns, ", "), partitionBy, orderBy)
+	res, err := w.query(context.Background(), query, nil)
+	if err != nil {
+		return err
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("create table %s error: [%d] %s", w.Table, res.StatusCode, msg)
+	}
+	return nil
+}
+
+func (w *ClickHouseWriter) query(ctx context.Context, query string, body []byte) (*http.Response, error) {
+	params := url.Values{}
+	params.Set("database", w.Database)
+	if body != nil {
+		params.Set("query", query)
+		params.Set("date_time_input_format", "best_effort")
+		params.Set("input_format_skip_unknown_fields", "1")
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	} else {
+		reader = strings.NewReader(query)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.endpoint+"?"+params.Encode(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(w.UserName) > 0 {
+		req.Header.Set("X-ClickHouse-User", w.UserName)
+		req.Header.Set("X-ClickHouse-Key", w.Password)
+	}
+	return w.client.Do(req)
+}
+
+// Stop close all
+func (w *ClickHouseWriter) Stop() {
+	close(w.exitChan)
+	w.wg.Wait()
+	w.guard.Close()
+	log.Println("exit clickhouse writer")
+	prometheus.Unregister(w.metricstatus)
+}
+
+// Start run writer
+func (w *ClickHouseWriter) Start(dataChan chan *map[string]interface{}) {
+	if !w.wg.Add() {
+		return
+	}
+	defer w.wg.Done()
+	var buf bytes.Buffer
+	count := 0
+	ticker := time.NewTicker(time.Duration(w.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.exitChan:
+			w.insert(buf.Bytes(), count)
+			return
+		case <-ticker.C:
+			w.insert(buf.Bytes(), count)
+			buf.Reset()
+			count = 0
+		case logmsg := <-dataChan:
+			data, err := json.Marshal(logmsg)
+			if err != nil {
+				w.metricstatus.WithLabelValues("encode_failed").Inc()
+				break
+			}
+			buf.Write(data)
+			buf.WriteByte('\n')
+			count++
+			if count >= w.BatchSize {
+				w.insert(buf.Bytes(), count)
+				buf.Reset()
+				count = 0
+			}
+		}
+	}
+}
+
+// insert send rows with INSERT ... FORMAT JSONEachRow through SinkGuard
+// network error, 429 and 502/503/504 are retried
+func (w *ClickHouseWriter) insert(body []byte, count int) {
+	if count == 0 {
+		return
+	}
+	query := fmt.Sprintf("INSERT INTO `%s`.`%s` FORMAT JSONEachRow", w.Database, w.Table)
+	if err := w.guard.Do(func(ctx context.Context) error {
+		res, err := w.query(ctx, query, body)
+		if err != nil {
+			return err
+		}
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		if res.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("clickhouse insert error: [%d] %s", res.StatusCode, msg)
+		switch res.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return err
+		}
+		return Permanent(err)
+	}); err != nil {
+		log.Println("clickhouse insert", err)
+		w.metricstatus.WithLabelValues("failed").Add(float64(count))
+		return
+	}
+	w.metricstatus.WithLabelValues("inserted").Add(float64(count))
+}
@@ -2,16 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
-	"github.com/afex/hystrix-go/hystrix"
 	elasticsearch "github.com/elastic/go-elasticsearch/v6"
 	elasticsearch7 "github.com/elastic/go-elasticsearch/v7"
+	elasticsearch8 "github.com/elastic/go-elasticsearch/v8"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -24,22 +34,92 @@ import (
 // "Type":"elasticsearch"
 // "FlushTimeout":"5",
 // "BulkCount":"100",
-// "Timeout":"10000",
-// "RequestVolumeThreshold":"20000",
-// "MaxConcurrentRequests":"100",
-// "ErrorPercentThreshold":"25",
+// "BulkSize":"5",
+// "Timeout":"30000",
+// "MaxRetry":"5",
+// "RetryBackoff":"1000",
+// "RetryMaxBackoff":"30000",
+// "BreakerThreshold":"5",
+// "BreakerCooldown":"30000",
+// "DeadLetterIndex":"lazy-deadletter",
+// "DeadLetterFile":"/var/log/lazy/deadletter.json",
+// "DataStream":"false",
+// "IndexPattern":"nginx-{Host}-%Y.%m.%d",
+// "TimestampField":"timestamp",
+// "IndexTimezone":"UTC",
+// "IDFields":"rawmsg,offset",
+// "IDTemplate":"{hostname}-{rawmsg}",
+// "SpoolDirectory":"/var/lib/lazy/es_spool",
+// "StopTimeout":"10",
+// "UserName":"lazy",
+// "PasswordFile":"/etc/lazy/es_password",
+// "APIKeyFile":"/etc/lazy/es_apikey",
+// "ServiceToken":"",
+// "TLSCAFile":"/etc/lazy/es_ca.pem",
+// "TLSCertFile":"",
+// "TLSKeyFile":"",
+// "TLSInsecureSkipVerify":"false",
 // }
+// Password, APIKey and ServiceToken can be read from xxxFile
+// ServiceToken is used first, then APIKey (base64 id:key), then UserName/Password
+// TaskCount bulk workers send batches of BulkCount docs or BulkSize MB,
+// pending docs are flushed every FlushTimeout seconds
+// _id is sha1 of IDTemplate or IDFields, retry overwrite the same doc instead of
+// creating duplicates, use kafka OffsetField to make raw msg unique,
+// msg missing one of the fields get an elasticsearch generated _id
+// IndexType is only sent to elasticsearch 6, 7+ and opensearch use no _type
+// IndexPattern use {field} and strftime of event TimestampField in IndexTimezone,
+// default is IndexPerfix-%Y.%m.%d, field values are lowercased and \ / * ? " < > | , # :
+// and space are replaced by _
+// DataStream write IndexPattern (default IndexPerfix) as data stream with op_type create and @timestamp
+// bulk requests go through SinkGuard, every request is bound to Timeout ms and
+// the next attempt starts only after it returned, failed batches are retried until
+// sent or stopped, with SpoolDirectory a batch is spooled at once when circuit is open
+// or its single attempt failed, items rejected with 429/503 are retried up to MaxRetry,
+// other rejected items are written to DeadLetterIndex or DeadLetterFile with the error
 type ElasticSearchWriter struct {
-	IndexPerfix  string
-	tasksCount   int
-	Type         string
-	esClient     *elasticsearch.Client
-	es7Client    *elasticsearch7.Client
-	BulkCount    int
-	FlushTimeout int
-	esVersion    int
-	exitChan     chan int
-	metricstatus *prometheus.CounterVec
+	sync.Mutex
+	IndexPerfix    string
+	tasksCount     int
+	Type           string
+	esClient       *elasticsearch.Client
+	es7Client      *elasticsearch7.Client
+	es8Client      *elasticsearch8.Client
+	BulkCount      int
+	FlushTimeout   int
+	esVersion      int
+	esMinorVersion int
+	Distribution   string
+	DataStream     bool
+	UserName       string
+	Password       string
+	transport      http.RoundTripper
+	nodes          *esNodePool
+	indexPattern   *FieldTemplate
+	indexLocation  *time.Location
+	idTemplate     *FieldTemplate
+	IDFields       []string
+	autoIDOnce     sync.Once
+	TimestampField string
+	// bulk items
+	MaxRetry        int
+	DeadLetterIndex string
+	DeadLetterFile  string
+	BulkSize        int
+	batchChan       chan []*esDoc
+	wg              sync.WaitGroup
+	readerWg        sinkWaitGroup
+	guard           *SinkGuard
+	loopWg          sync.WaitGroup
+	stopChan        chan int
+	exitChan        chan int
+	StopTimeout     time.Duration
+	SpoolDirectory  string
+	SpoolMaxSize    int64
+	spoolSize       int64
+	spoolSeq        int
+	segments        []string
+	metricstatus    *prometheus.CounterVec
 }
 
 /*
@@ -62,11 +142,81 @@ type ElasticSearchWriter struct {
 }
 */
 
+// esAuthTransport set Authorization header for api key and service token
+type esAuthTransport struct {
+	authorization string
+	next          http.RoundTripper
+}
+
+// RoundTrip add Authorization to request
+func (t *esAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", t.authorization)
+	return t.next.RoundTrip(req)
+}
+
+// configSecret read config[key] or the content of config[key+"File"]
+func configSecret(config map[string]string, key string) (string, error) {
+	if len(config[key+"File"]) > 0 {
+		data, err := ioutil.ReadFile(config[key+"File"])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return config[key], nil
+}
+
+type esInfo struct {
+	Version struct {
+		Number       string `json:"number"`
+		Distribution string `json:"distribution"`
+	} `json:"version"`
+}
+
+// parseESVersion get major and minor version from 7.10.2
+func parseESVersion(number string) (int, int) {
+	items := strings.SplitN(number, ".", 3)
+	major, _ := strconv.Atoi(items[0])
+	minor := 0
+	if len(items) > 1 {
+		minor, _ = strconv.Atoi(items[1])
+	}
+	return major, minor
+}
+
 // NewElasitcSearchWriter create new object
-func NewElasitcSearchWriter(config map[string]string) (*ElasticSearchWriter, error) {
+func NewElasitcSearchWriter(config map[string]string, parser *LogParser) (*ElasticSearchWriter, error) {
 	var err error
 	hosts := strings.Split(config["ElasticSearchEndPoint"], ",")
-	es := &ElasticSearchWriter{IndexPerfix: config["IndexPerfix"]}
+	es := &ElasticSearchWriter{
+		IndexPerfix:     config["IndexPerfix"],
+		DeadLetterIndex: config["DeadLetterIndex"],
+		DeadLetterFile:  config["DeadLetterFile"],
+		DataStream:      config["DataStream"] == "true",
+		TimestampField:  config["TimestampField"],
+	}
+	if len(es.TimestampField) == 0 {
+		es.TimestampField = "timestamp"
+	}
+	if len(config["IDTemplate"]) > 0 {
+		es.idTemplate = NewFieldTemplate(config["IDTemplate"])
+	}
+	es.IDFields = splitKeys(config["IDFields"])
+	pattern := config["IndexPattern"]
+	if len(pattern) == 0 {
+		pattern = es.IndexPerfix + "-%Y.%m.%d"
+		if es.DataStream {
+			pattern = es.IndexPerfix
+		}
+	}
+	es.indexPattern = NewFieldTemplate(pattern)
+	es.indexLocation = time.UTC
+	if len(config["IndexTimezone"]) > 0 {
+		es.indexLocation, err = time.LoadLocation(config["IndexTimezone"])
+		if err != nil {
+			return nil, err
+		}
+	}
 	if len(config["FlushTimeout"]) < 1 {
 		config["FlushTimeout"] = "5"
 	}
@@ -81,14 +231,59 @@ func NewElasitcSearchWriter(config map[string]string) (*ElasticSearchWriter, err
 	if err != nil {
 		es.BulkCount = 100
 	}
+	es.MaxRetry, err = strconv.Atoi(config["MaxRetry"])
+	if err != nil || es.MaxRetry < 0 {
+		es.MaxRetry = 5
+	}
+	es.UserName = config["UserName"]
+	es.Password, err = configSecret(config, "Password")
+	if err != nil {
+		return nil, err
+	}
+	apiKey, err := configSecret(config, "APIKey")
+	if err != nil {
+		return nil, err
+	}
+	serviceToken, err := configSecret(config, "ServiceToken")
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	transport.TLSClientConfig, err = NewTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	es.nodes, err = newESNodePool(hosts, transport)
+	if err != nil {
+		return nil, err
+	}
+	es.nodes.Compression = config["Compression"]
+	if cooldown, err := strconv.Atoi(config["NodeCooldown"]); err == nil && cooldown > 0 {
+		es.nodes.Cooldown = time.Duration(cooldown) * time.Second
+	}
+	es.transport = es.nodes
+	switch {
+	case len(serviceToken) > 0:
+		es.transport = &esAuthTransport{authorization: "Bearer " + serviceToken, next: es.nodes}
+	case len(apiKey) > 0:
+		es.transport = &esAuthTransport{authorization: "ApiKey " + apiKey, next: es.nodes}
+	}
 	cfg := elasticsearch.Config{
 		Addresses: hosts,
+		Username:  es.UserName,
+		Password:  es.Password,
+		Transport: es.transport,
 	}
 	es.esClient, err = elasticsearch.NewClient(cfg)
 	if err != nil {
 		log.Println("create elastic client", err)
 		return nil, err
 	}
+	if config["Sniff"] == "true" {
+		if err = es.sniff(); err != nil {
+			log.Println("elasticsearch sniff", err)
+		}
+	}
 	res, err := es.esClient.Info()
 	if err != nil {
 		log.Printf("Error getting response: %s", err)
@@ -97,25 +292,83 @@ func NewElasitcSearchWriter(config map[string]string) (*ElasticSearchWriter, err
 	if res.IsError() {
 		log.Printf("Error: %s", res.String())
 	}
-	var r map[string]interface{}
+	var r esInfo
 	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
 		log.Printf("Error parsing the response body: %s", err)
 	}
-	es.esVersion = 6
-	if r["version"].(map[string]interface{})["number"] == '7' {
-		es.esVersion = 7
+	res.Body.Close()
+	es.Distribution = "elasticsearch"
+	es.esVersion, es.esMinorVersion = parseESVersion(r.Version.Number)
+	if r.Version.Distribution == "opensearch" {
+		// opensearch is forked from 7.10 and keeps its api
+		es.Distribution = "opensearch"
+		es.esVersion, es.esMinorVersion = 7, 10
+	}
+	if es.esVersion < 6 {
+		return es, fmt.Errorf("not supported elasticsearch version %s", r.Version.Number)
+	}
+	if es.DataStream && (es.esVersion < 7 || es.esVersion == 7 && es.esMinorVersion < 9) {
+		return es, fmt.Errorf("data stream need elasticsearch 7.9+, got %s", r.Version.Number)
+	}
+	switch {
+	case es.esVersion >= 8:
+		cfg := elasticsearch8.Config{
+			Addresses: hosts,
+			Username:  es.UserName,
+			Password:  es.Password,
+			Transport: es.transport,
+			// bulk is retried by writer, client retry would duplicate docs
+			DisableRetry: true,
+		}
+		es.es8Client, err = elasticsearch8.NewClient(cfg)
+		if err != nil {
+			return es, err
+		}
+	case es.esVersion == 7:
+		// opensearch is reported as 7.10
 		cfg := elasticsearch7.Config{
 			Addresses: hosts,
+			Username:  es.UserName,
+			Password:  es.Password,
+			Transport: es.transport,
 		}
 		es.es7Client, err = elasticsearch7.NewClient(cfg)
+		if err != nil {
+			return es, err
+		}
+	}
+	log.Printf("elasticsearch %s %s", es.Distribution, r.Version.Number)
+	es.Type = config["IndexType"]
+	if len(es.Type) == 0 {
+		es.Type = "_doc"
 	}
-	fmt.Println("Start elasticsearch writer")
+	if err = es.bootstrap(config, parser); err != nil {
+		return es, err
+	}
+	log.Println("Start elasticsearch writer")
 	es.tasksCount, err = strconv.Atoi(config["TaskCount"])
-	if err != nil {
+	if err != nil || es.tasksCount < 1 {
 		es.tasksCount = 5
 	}
+	es.BulkSize, err = strconv.Atoi(config["BulkSize"])
+	if err != nil || es.BulkSize < 1 {
+		es.BulkSize = 5
+	}
+	es.BulkSize = es.BulkSize * 1024 * 1024
 	es.exitChan = make(chan int)
-	es.Type = config["IndexType"]
+	es.stopChan = make(chan int)
+	es.SpoolDirectory = config["SpoolDirectory"]
+	spoolMaxSize, err := strconv.Atoi(config["SpoolMaxSize"])
+	if err != nil || spoolMaxSize < 1 {
+		spoolMaxSize = 1024
+	}
+	es.SpoolMaxSize = int64(spoolMaxSize) * 1024 * 1024
+	stopTimeout, err := strconv.Atoi(config["StopTimeout"])
+	if err != nil || stopTimeout < 1 {
+		stopTimeout = 10
+	}
+	es.StopTimeout = time.Duration(stopTimeout) * time.Second
+	es.batchChan = make(chan []*esDoc, es.tasksCount)
 	es.metricstatus = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Subsystem: "elasticsearch",
@@ -124,143 +377,462 @@ func NewElasitcSearchWriter(config map[string]string) (*ElasticSearchWriter, err
 		},
 		[]string{"opt"},
 	)
-	if len(config["Timeout"]) < 1 {
-		config["Timeout"] = "5000"
+	// Timeout bound every bulk request, SinkGuard read retry and breaker settings
+	guard := guardConfig(config, map[string]string{"AttemptTimeout": config["Timeout"], "RetryBackoff": "1000"})
+	if timeout, err := strconv.Atoi(guard["AttemptTimeout"]); err != nil || timeout < 1000 {
+		guard["AttemptTimeout"] = "30000"
 	}
-	if len(config["RequestVolumeThreshold"]) < 1 {
-		config["RequestVolumeThreshold"] = "20000"
+	es.guard = NewSinkGuard("elasticsearch", guard)
+	es.nodes.metricstatus = es.metricstatus
+	// Register status
+	prometheus.Register(es.metricstatus)
+	if len(es.SpoolDirectory) > 0 {
+		if err = es.openSpool(); err != nil {
+			es.guard.Close()
+			prometheus.Unregister(es.metricstatus)
+			return es, err
+		}
+		es.loopWg.Add(1)
+		go es.replayLoop()
 	}
-	if len(config["MaxConcurrentRequests"]) < 1 {
-		config["MaxConcurrentRequests"] = "64"
+	if config["Sniff"] == "true" {
+		interval, err := strconv.Atoi(config["SniffInterval"])
+		if err != nil || interval < 1 {
+			interval = 300
+		}
+		es.loopWg.Add(1)
+		go es.sniffLoop(time.Duration(interval) * time.Second)
 	}
-	if len(config["ErrorPercentThreshold"]) < 1 {
-		config["ErrorPercentThreshold"] = "25"
+	for i := 0; i < es.tasksCount; i++ {
+		es.wg.Add(1)
+		go es.bulkWorker()
 	}
-
-	timeout, err := strconv.Atoi(config["Timeout"])
-	if timeout < 1000 {
-		timeout = 1000
-	}
-	requestVolumeThreshold, err := strconv.Atoi(config["RequestVolumeThreshold"])
-	if requestVolumeThreshold < 1 {
-		requestVolumeThreshold = 20000
-	}
-	maxConcurrentRequests, err := strconv.Atoi(config["MaxConcurrentRequests"])
-	if maxConcurrentRequests < 1 {
-		maxConcurrentRequests = 100
-	}
-	errorPercentThreshold, err := strconv.Atoi(config["ErrorPercentThreshold"])
-	if errorPercentThreshold < 1 {
-		errorPercentThreshold = 25
-	}
-	hystrix.ConfigureCommand(fmt.Sprintf("%s_BulkInsert", es.IndexPerfix), hystrix.CommandConfig{
-		Timeout:                timeout,
-		RequestVolumeThreshold: requestVolumeThreshold,
-		MaxConcurrentRequests:  maxConcurrentRequests,
-		ErrorPercentThreshold:  errorPercentThreshold,
-	})
-	// Register status
-	prometheus.Register(es.metricstatus)
-	return es, err
+	return es, nil
 }
 
-// Stop stop all
+// Stop flush pending docs until StopTimeout, then spool or drop the rest
 func (es *ElasticSearchWriter) Stop() {
+	deadline := time.AfterFunc(es.StopTimeout, func() {
+		close(es.exitChan)
+		// cancel bulk in flight, its docs are spooled
+		es.guard.Abort()
+	})
+	close(es.stopChan)
+	es.readerWg.Wait()
+	close(es.batchChan)
+	es.wg.Wait()
+	if deadline.Stop() {
+		close(es.exitChan)
+		es.guard.Abort()
+	}
+	es.loopWg.Wait()
+	for docs := range es.batchChan {
+		es.spill(docs)
+	}
+	log.Println("exit elasticsearch")
+	es.guard.Close()
 	prometheus.Unregister(es.metricstatus)
-	close(es.exitChan)
 }
 
-// Start start read/insert data
+// Start start read data, batch is sent to bulk workers
+// when BulkCount or BulkSize is reached or every FlushTimeout
 func (es *ElasticSearchWriter) Start(dataChan chan *map[string]interface{}) {
-	ticker := time.Tick(time.Second * 60)
-	flushticker := time.Tick(time.Second * time.Duration(es.FlushTimeout))
-	yy, mm, dd := time.Now().Date()
-	indexName := fmt.Sprintf("%s-%d.%d.%d", es.IndexPerfix, yy, mm, dd)
-	var buf bytes.Buffer
-	count := 0
-	meta := []byte(fmt.Sprintf(`{"index":{"_index":"%s","_type":"%s"}}%s`, indexName, es.Type, "\n"))
-	var raw map[string]interface{}
-	var flushTimeout bool
+	if !es.readerWg.Add() {
+		return
+	}
+	defer es.readerWg.Done()
+	flushticker := time.NewTicker(time.Second * time.Duration(es.FlushTimeout))
+	defer flushticker.Stop()
+	var docs []*esDoc
+	size := 0
+	metas := make(map[string][]byte)
+	flush := func() bool {
+		if len(docs) == 0 {
+			return true
+		}
+		select {
+		case es.batchChan <- docs:
+			docs = nil
+			size = 0
+			return true
+		case <-es.exitChan:
+			es.spill(docs)
+			return false
+		}
+	}
 	for {
 		select {
-		case <-ticker:
-			yy, mm, dd := time.Now().Date()
-			indexName = fmt.Sprintf("%s-%d.%d.%d", es.IndexPerfix, yy, mm, dd)
-			meta = []byte(fmt.Sprintf(`{"index":{"_index":"%s","_type":"%s"}}%s`, indexName, es.Type, "\n"))
-			//es.Stats()
-		case <-flushticker:
-			flushTimeout = true
+		case <-flushticker.C:
+			if !flush() {
+				return
+			}
 		case msg := <-dataChan:
+			ts := es.eventTime(msg)
+			if es.DataStream {
+				if _, ok := (*msg)["@timestamp"]; !ok {
+					(*msg)["@timestamp"] = ts
+				}
+			}
+			indexName := es.indexName(msg, ts.In(es.indexLocation))
+			id := es.docID(msg)
+			meta, ok := metas[indexName]
+			if len(id) > 0 {
+				meta = es.bulkMeta(indexName, id)
+			} else if !ok {
+				if len(metas) > 1000 {
+					metas = make(map[string][]byte)
+				}
+				meta = es.bulkMeta(indexName, "")
+				metas[indexName] = meta
+			}
 			data, _ := json.Marshal(msg)
-			buf.Grow(len(meta) + len(data) + 1)
-			buf.Write(meta)
-			buf.Write(data)
-			buf.Write([]byte("\n"))
-			count++
-		retry:
-			if count > es.BulkCount || flushTimeout {
-				err := hystrix.Do(fmt.Sprintf("%s_BulkInsert", es.IndexPerfix), func() error {
-					switch es.esVersion {
-					case 6:
-						res, err := es.esClient.Bulk(bytes.NewReader(buf.Bytes()))
-						if err != nil {
-							es.metricstatus.WithLabelValues("Failed").Add(float64(es.BulkCount))
-							return err
-						}
-						if res.IsError() {
-							if err = json.NewDecoder(res.Body).Decode(&raw); err == nil {
-								log.Printf("  Error: [%d] %s: %s",
-									res.StatusCode,
-									raw["error"].(map[string]interface{})["type"],
-									raw["error"].(map[string]interface{})["reason"],
-								)
-							}
-							res.Body.Close()
-							es.metricstatus.WithLabelValues("Failed").Add(float64(es.BulkCount))
-							time.Sleep(time.Second)
-							return fmt.Errorf("%s", raw["error"].(map[string]interface{})["reason"])
-						}
-						es.metricstatus.WithLabelValues("Indexed").Add(float64(es.BulkCount))
-						res.Body.Close()
-					case 7:
-						res, err := es.es7Client.Bulk(bytes.NewReader(buf.Bytes()))
-						if err != nil {
-							es.metricstatus.WithLabelValues("Failed").Add(float64(es.BulkCount))
-							return err
-						}
-						if res.IsError() {
-							if err = json.NewDecoder(res.Body).Decode(&raw); err == nil {
-								log.Printf("  Error: [%d] %s: %s",
-									res.StatusCode,
-									raw["error"].(map[string]interface{})["type"],
-									raw["error"].(map[string]interface{})["reason"],
-								)
-							}
-							res.Body.Close()
-							es.metricstatus.WithLabelValues("Failed").Add(float64(es.BulkCount))
-							time.Sleep(time.Second)
-							return fmt.Errorf("%s", raw["error"].(map[string]interface{})["reason"])
-						}
-						es.metricstatus.WithLabelValues("Indexed").Add(float64(es.BulkCount))
-						res.Body.Close()
-					default:
-					}
-					count = 0
-					flushTimeout = false
-					buf.Reset()
-					es.metricstatus.WithLabelValues("Flushed").Inc()
-					return nil
-				}, nil)
-				if err != nil {
-					time.Sleep(time.Second)
-					goto retry
+			docs = append(docs, &esDoc{index: indexName, id: id, meta: meta, data: data})
+			size += len(meta) + len(data) + 1
+			if len(docs) >= es.BulkCount || size >= es.BulkSize {
+				if !flush() {
+					return
 				}
 			}
+		case <-es.stopChan:
+			flush()
+			return
+		}
+	}
+}
+
+// bulkWorker send batches, TaskCount workers bound bulk requests in flight
+func (es *ElasticSearchWriter) bulkWorker() {
+	defer es.wg.Done()
+	for {
+		select {
+		case docs, ok := <-es.batchChan:
+			if !ok {
+				return
+			}
+			es.send(docs)
+		case <-es.exitChan:
+			return
+		}
+	}
+}
+
+// send bulk docs through SinkGuard until all docs are done,
+// docs are spooled while spool has segments, circuit is open or request failed
+func (es *ElasticSearchWriter) send(docs []*esDoc) {
+	if len(es.SpoolDirectory) > 0 && es.spooling() {
+		es.spill(docs)
+		return
+	}
+	spool := len(es.SpoolDirectory) > 0
+	for len(docs) > 0 {
+		// with spool, a batch is tried once and spilled on failure, replay retries it
+		if spool && es.guard.IsOpen() {
+			es.spill(docs)
+			return
+		}
+		var retry []*esDoc
+		fn := func(ctx context.Context) error {
+			var err error
+			retry, err = es.bulk(ctx, docs)
+			return err
+		}
+		var err error
+		if spool {
+			err = es.guard.Try(fn)
+		} else {
+			err = es.guard.Do(fn)
+		}
+		if err == nil {
+			es.metricstatus.WithLabelValues("Flushed").Inc()
+			docs = retry
+			continue
+		}
+		log.Println("elasticsearch bulk", err)
+		if spool {
+			es.spill(docs)
+			return
+		}
+		select {
 		case <-es.exitChan:
-			log.Println("exit elasticsearch")
+			es.spill(docs)
+			return
+		default:
+		}
+	}
+}
+
+// eventTime get TimestampField of msg, use now if missing
+func (es *ElasticSearchWriter) eventTime(msg *map[string]interface{}) time.Time {
+	switch v := (*msg)[es.TimestampField].(type) {
+	case time.Time:
+		return v
+	case string:
+		if ts, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return ts
+		}
+	case int64:
+		return time.Unix(0, v*int64(time.Millisecond))
+	}
+	return time.Now()
+}
+
+// indexName render IndexPattern, field values are lowercased and characters
+// elasticsearch does not allow in index names are replaced by _
+func (es *ElasticSearchWriter) indexName(msg *map[string]interface{}, ts time.Time) string {
+	name := es.indexPattern.RenderTimeFunc(func(field string) (string, bool) {
+		value, ok := LookupField(msg, field)
+		return esIndexValue(value), ok
+	}, ts)
+	// index name can not start with _, - or +
+	return strings.TrimLeft(name, "_-+")
+}
+
+func esIndexValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\\', '/', '*', '?', '"', '<', '>', '|', ' ', ',', '#', ':':
+			return '_'
+		}
+		if r < 32 {
+			return '_'
+		}
+		return unicode.ToLower(r)
+	}, value)
+}
+
+// docID hash IDTemplate or IDFields of msg, empty for auto id,
+// msg missing one of the fields use auto id, or all such msg would share one _id
+func (es *ElasticSearchWriter) docID(msg *map[string]interface{}) string {
+	h := sha1.New()
+	missing := ""
+	lookup := func(name string) (string, bool) {
+		value, ok := LookupField(msg, name)
+		if !ok && len(missing) == 0 {
+			missing = name
+		}
+		return value, ok
+	}
+	switch {
+	case es.idTemplate != nil:
+		io.WriteString(h, es.idTemplate.RenderFunc(lookup))
+	case len(es.IDFields) > 0:
+		for _, field := range es.IDFields {
+			value, _ := lookup(field)
+			io.WriteString(h, value)
+			h.Write([]byte{0})
+		}
+	default:
+		return ""
+	}
+	if len(missing) > 0 {
+		es.autoIDOnce.Do(func() {
+			log.Println("elasticsearch _id field", missing, "missing, use auto id")
+		})
+		es.metricstatus.WithLabelValues("AutoID").Inc()
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// bulkMeta action line, data stream only accept create
+func (es *ElasticSearchWriter) bulkMeta(index, id string) []byte {
+	op := "index"
+	if es.DataStream {
+		op = "create"
+	}
+	action := map[string]string{"_index": index}
+	if len(id) > 0 {
+		action["_id"] = id
+	}
+	if es.esVersion < 7 {
+		action["_type"] = es.Type
+	}
+	meta, _ := json.Marshal(map[string]interface{}{op: action})
+	return append(meta, '\n')
+}
+
+// esDoc one bulk action
+type esDoc struct {
+	index    string
+	id       string
+	meta     []byte
+	data     []byte
+	attempts int
+}
+
+type esBulkResponse struct {
+	Errors bool                    `json:"errors"`
+	Items  []map[string]esBulkItem `json:"items"`
+}
+
+type esBulkItem struct {
+	Index  string       `json:"_index"`
+	Status int          `json:"status"`
+	Error  *esItemError `json:"error"`
+}
+
+type esItemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// doBulk send bulk body, return http status and response body
+func (es *ElasticSearchWriter) doBulk(ctx context.Context, body []byte) (int, []byte, error) {
+	switch {
+	case es.es8Client != nil:
+		res, err := es.es8Client.Bulk(bytes.NewReader(body), es.es8Client.Bulk.WithContext(ctx))
+		if err != nil {
+			return 0, nil, err
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		return res.StatusCode, data, err
+	case es.es7Client != nil:
+		res, err := es.es7Client.Bulk(bytes.NewReader(body), es.es7Client.Bulk.WithContext(ctx))
+		if err != nil {
+			return 0, nil, err
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		return res.StatusCode, data, err
+	default:
+		res, err := es.esClient.Bulk(bytes.NewReader(body), es.esClient.Bulk.WithContext(ctx))
+		if err != nil {
+			return 0, nil, err
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		return res.StatusCode, data, err
+	}
+}
+
+// bulk send docs, return docs to retry
+// request error return all docs, items rejected with 429/503 are returned
+// until MaxRetry, other rejected items are sent to dead letter
+func (es *ElasticSearchWriter) bulk(ctx context.Context, docs []*esDoc) ([]*esDoc, error) {
+	if len(docs) == 0 {
+		return docs, nil
+	}
+	// group actions by index, items of response follow the sorted order
+	sort.SliceStable(docs, func(i, j int) bool {
+		return docs[i].index < docs[j].index
+	})
+	var buf bytes.Buffer
+	for _, doc := range docs {
+		buf.Grow(len(doc.meta) + len(doc.data) + 1)
+		buf.Write(doc.meta)
+		buf.Write(doc.data)
+		buf.WriteByte('\n')
+	}
+	status, body, err := es.doBulk(ctx, buf.Bytes())
+	if err != nil {
+		es.metricstatus.WithLabelValues("Failed").Add(float64(len(docs)))
+		return docs, err
+	}
+	if status > 299 {
+		var raw struct {
+			Error esItemError `json:"error"`
+		}
+		if err = json.Unmarshal(body, &raw); err == nil && len(raw.Error.Type) > 0 {
+			err = fmt.Errorf("[%d] %s: %s", status, raw.Error.Type, raw.Error.Reason)
+		} else {
+			err = fmt.Errorf("[%d] %s", status, body)
+		}
+		log.Println("  Error:", err)
+		es.metricstatus.WithLabelValues("Failed").Add(float64(len(docs)))
+		return docs, err
+	}
+	var rsp esBulkResponse
+	if err = json.Unmarshal(body, &rsp); err != nil || len(rsp.Items) != len(docs) {
+		// bulk is accepted, resend may duplicate docs
+		log.Println("bad bulk response", err)
+		es.metricstatus.WithLabelValues("Unknown").Add(float64(len(docs)))
+		return docs[:0], nil
+	}
+	var retry []*esDoc
+	indexed := 0
+	for i, item := range rsp.Items {
+		for _, result := range item {
+			if result.Status < 300 {
+				indexed++
+				continue
+			}
+			if result.Status == http.StatusConflict && es.DataStream && len(docs[i].id) > 0 {
+				// created by a former attempt
+				es.metricstatus.WithLabelValues("Duplicated").Inc()
+				continue
+			}
+			errType, reason := "unknown", ""
+			if result.Error != nil {
+				errType, reason = result.Error.Type, result.Error.Reason
+			}
+			es.metricstatus.WithLabelValues("Error_" + errType).Inc()
+			doc := docs[i]
+			doc.attempts++
+			if (result.Status == 429 || result.Status == 503) && doc.attempts <= es.MaxRetry {
+				retry = append(retry, doc)
+				es.metricstatus.WithLabelValues("Retried").Inc()
+				continue
+			}
+			es.deadLetter(ctx, doc, result.Status, errType, reason)
+		}
+	}
+	es.metricstatus.WithLabelValues("Indexed").Add(float64(indexed))
+	if len(retry) > 0 {
+		// wait cluster recover
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		}
+	}
+	return retry, nil
+}
+
+// deadLetter save rejected doc with es error to DeadLetterIndex or DeadLetterFile
+func (es *ElasticSearchWriter) deadLetter(ctx context.Context, doc *esDoc, status int, errType, reason string) {
+	es.metricstatus.WithLabelValues("Rejected").Inc()
+	if len(es.DeadLetterIndex) == 0 && len(es.DeadLetterFile) == 0 {
+		log.Printf("drop doc for %s: [%d] %s: %s", doc.index, status, errType, reason)
+		return
+	}
+	record, _ := json.Marshal(map[string]interface{}{
+		"timestamp":    time.Now(),
+		"index":        doc.index,
+		"status":       status,
+		"error_type":   errType,
+		"error_reason": reason,
+		"document":     string(doc.data),
+	})
+	if len(es.DeadLetterIndex) > 0 {
+		meta := []byte(fmt.Sprintf(`{"index":{"_index":"%s"}}%s`, es.DeadLetterIndex, "\n"))
+		if es.esVersion < 7 {
+			meta = []byte(fmt.Sprintf(`{"index":{"_index":"%s","_type":"%s"}}%s`, es.DeadLetterIndex, es.Type, "\n"))
+		}
+		body := append(append(meta, record...), '\n')
+		status, data, err := es.doBulk(ctx, body)
+		if err == nil && status < 300 && !bytes.Contains(data, []byte(`"errors":true`)) {
+			es.metricstatus.WithLabelValues("DeadLettered").Inc()
 			return
 		}
+		log.Println("dead letter index", status, err)
+		if len(es.DeadLetterFile) == 0 {
+			es.metricstatus.WithLabelValues("DeadLetterFailed").Inc()
+			return
+		}
+	}
+	es.Lock()
+	defer es.Unlock()
+	f, err := os.OpenFile(es.DeadLetterFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = f.Write(append(record, '\n'))
+		f.Close()
+	}
+	if err != nil {
+		log.Println("dead letter file", err)
+		es.metricstatus.WithLabelValues("DeadLetterFailed").Inc()
+		return
 	}
+	es.metricstatus.WithLabelValues("DeadLettered").Inc()
 }
 
 /*
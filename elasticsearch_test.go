@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestElasticSearchIndexName(t *testing.T) {
+	ts := time.Date(2019, time.March, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		pattern string
+		msg     map[string]interface{}
+		want    string
+	}{
+		{"nginx-{Host}-%Y.%m.%d", map[string]interface{}{"Host": "web1"}, "nginx-web1-2019.03.04"},
+		{"nginx-{Host}-%Y.%m.%d", map[string]interface{}{"Host": "Web One"}, "nginx-web_one-2019.03.04"},
+		{"app-{tag}", map[string]interface{}{"tag": `a*b,c#d/e\f?g"h<i>j|k:l`}, "app-a_b_c_d_e_f_g_h_i_j_k_l"},
+		{"{tag}-%Y", map[string]interface{}{"tag": "_Internal"}, "internal-2019"},
+		{"{tag}-%Y", map[string]interface{}{"tag": "-+x"}, "x-2019"},
+		{"logs-{missing}", map[string]interface{}{}, "logs-"},
+	}
+	for _, tt := range tests {
+		es := &ElasticSearchWriter{indexPattern: NewFieldTemplate(tt.pattern)}
+		if got := es.indexName(&tt.msg, ts); got != tt.want {
+			t.Errorf("%q %v indexName() = %q, want %q", tt.pattern, tt.msg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// config
+// {
+// "Compression":"gzip",
+// "Sniff":"true",
+// "SniffInterval":"300",
+// "NodeCooldown":"30"
+// }
+// Compression gzip bulk request bodies
+// Sniff discover http nodes by _nodes/http on start and every SniffInterval seconds,
+// ElasticSearchEndPoint is used when no node is found, with https only nodes
+// published with a hostname are used
+// requests are sent to nodes round robin, a node with connection error or 502/503/504
+// is ejected for NodeCooldown seconds and the request is sent to next node,
+// _bulk is only sent to next node on connection error, 502/503/504 is returned
+
+type esNode struct {
+	url       *url.URL
+	deadUntil time.Time
+}
+
+// esNodePool round robin healthy nodes
+type esNodePool struct {
+	sync.Mutex
+	nodes        []*esNode
+	seeds        []*url.URL
+	next         int
+	Compression  string
+	Cooldown     time.Duration
+	transport    http.RoundTripper
+	metricstatus *prometheus.CounterVec
+}
+
+func newESNodePool(hosts []string, transport http.RoundTripper) (*esNodePool, error) {
+	p := &esNodePool{transport: transport, Cooldown: 30 * time.Second}
+	for _, host := range hosts {
+		u, err := url.Parse(strings.TrimSpace(host))
+		if err != nil {
+			return nil, err
+		}
+		if len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return nil, fmt.Errorf("bad elasticsearch endpoint %s", host)
+		}
+		p.seeds = append(p.seeds, u)
+	}
+	if len(p.seeds) == 0 {
+		return nil, fmt.Errorf("no elasticsearch endpoint")
+	}
+	p.setNodes(p.seeds)
+	return p, nil
+}
+
+// setNodes replace nodes, ejected nodes keep their state
+func (p *esNodePool) setNodes(urls []*url.URL) {
+	p.Lock()
+	defer p.Unlock()
+	dead := make(map[string]time.Time)
+	for _, node := range p.nodes {
+		dead[node.url.Host] = node.deadUntil
+	}
+	nodes := make([]*esNode, 0, len(urls))
+	for _, u := range urls {
+		nodes = append(nodes, &esNode{url: u, deadUntil: dead[u.Host]})
+	}
+	p.nodes = nodes
+	p.next = 0
+}
+
+// pick next healthy node, the one back soonest if all are ejected
+func (p *esNodePool) pick() *esNode {
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	var soonest *esNode
+	for i := 0; i < len(p.nodes); i++ {
+		node := p.nodes[(p.next+i)%len(p.nodes)]
+		if !now.Before(node.deadUntil) {
+			p.next = (p.next + i + 1) % len(p.nodes)
+			return node
+		}
+		if soonest == nil || node.deadUntil.Before(soonest.deadUntil) {
+			soonest = node
+		}
+	}
+	return soonest
+}
+
+func (p *esNodePool) mark(node *esNode, err error) {
+	p.Lock()
+	defer p.Unlock()
+	if err == nil {
+		node.deadUntil = time.Time{}
+		return
+	}
+	if time.Now().Before(node.deadUntil) {
+		return
+	}
+	node.deadUntil = time.Now().Add(p.Cooldown)
+	log.Println("eject elasticsearch node", node.url.Host, err)
+	if p.metricstatus != nil {
+		p.metricstatus.WithLabelValues("NodeEjected").Inc()
+	}
+}
+
+// RoundTrip send req to healthy nodes until one answers, _bulk is not
+// resent after a status reply
+func (p *esNodePool) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	header := make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		header[k] = v
+	}
+	bulk := strings.HasSuffix(req.URL.Path, "/_bulk")
+	if p.Compression == "gzip" && len(body) > 0 && bulk {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+	p.Lock()
+	tries := len(p.nodes)
+	p.Unlock()
+	var res *http.Response
+	var err error
+	for i := 0; i < tries; i++ {
+		node := p.pick()
+		r := req.WithContext(req.Context())
+		u := *req.URL
+		u.Scheme, u.Host = node.url.Scheme, node.url.Host
+		r.URL, r.Host, r.Header = &u, "", header
+		r.ContentLength = int64(len(body))
+		if req.Body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
+			}
+		}
+		res, err = p.transport.RoundTrip(r)
+		if err == nil {
+			switch res.StatusCode {
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				p.mark(node, fmt.Errorf("status %d", res.StatusCode))
+				// bulk may be applied already, the caller retries it
+				if bulk {
+					return res, nil
+				}
+				if i < tries-1 {
+					res.Body.Close()
+				}
+				continue
+			}
+			p.mark(node, nil)
+			return res, nil
+		}
+		p.mark(node, err)
+		if req.Context().Err() != nil {
+			break
+		}
+	}
+	return res, err
+}
+
+// sniff update nodes from _nodes/http
+func (es *ElasticSearchWriter) sniff() error {
+	status, data, err := es.perform("GET", "/_nodes/http", nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("sniff nodes: [%d] %s", status, data)
+	}
+	var r struct {
+		Nodes map[string]struct {
+			HTTP struct {
+				PublishAddress string `json:"publish_address"`
+			} `json:"http"`
+		} `json:"nodes"`
+	}
+	if err = json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	scheme := es.nodes.seeds[0].Scheme
+	var urls []*url.URL
+	for _, node := range r.Nodes {
+		address := node.HTTP.PublishAddress
+		if len(address) == 0 {
+			continue
+		}
+		// hostname/ip:port, keep hostname so https certificates still match
+		hostname := ""
+		if i := strings.LastIndex(address, "/"); i >= 0 {
+			hostname, address = address[:i], address[i+1:]
+		}
+		if len(hostname) > 0 {
+			_, port, err := net.SplitHostPort(address)
+			if err != nil {
+				continue
+			}
+			address = net.JoinHostPort(hostname, port)
+		} else if scheme == "https" {
+			// an ip would fail certificate verification
+			continue
+		}
+		urls = append(urls, &url.URL{Scheme: scheme, Host: address})
+	}
+	if len(urls) == 0 {
+		urls = es.nodes.seeds
+	}
+	es.nodes.setNodes(urls)
+	return nil
+}
+
+func (es *ElasticSearchWriter) sniffLoop(interval time.Duration) {
+	defer es.loopWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-es.exitChan:
+			return
+		case <-ticker.C:
+			if err := es.sniff(); err != nil {
+				log.Println("elasticsearch sniff", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// config
+// {
+// "SpoolDirectory":"/var/lib/lazy/es_spool",
+// "SpoolMaxSize":"1024",
+// "StopTimeout":"10"
+// }
+// batches which can not be sent are written to SpoolDirectory as segment files
+// of bulk lines, new batches are spooled too until all segments are replayed in order
+// SpoolMaxSize in MB, batches are dropped when it is full
+// Stop flush pending docs within StopTimeout seconds, unsent docs are spooled
+
+// openSpool load segments left by last run
+func (es *ElasticSearchWriter) openSpool() error {
+	if err := os.MkdirAll(es.SpoolDirectory, 0755); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(es.SpoolDirectory)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		switch {
+		case strings.HasSuffix(f.Name(), ".tmp"):
+			os.Remove(filepath.Join(es.SpoolDirectory, f.Name()))
+		case strings.HasPrefix(f.Name(), "seg-") && strings.HasSuffix(f.Name(), ".bulk"):
+			es.segments = append(es.segments, f.Name())
+			es.spoolSize += f.Size()
+		}
+	}
+	sort.Strings(es.segments)
+	if len(es.segments) > 0 {
+		log.Printf("elasticsearch spool has %d segments to replay", len(es.segments))
+	}
+	return nil
+}
+
+// spooling return true if segments are waiting to be replayed
+func (es *ElasticSearchWriter) spooling() bool {
+	es.Lock()
+	defer es.Unlock()
+	return len(es.segments) > 0
+}
+
+// spill write docs to a new segment, docs are dropped without spool
+func (es *ElasticSearchWriter) spill(docs []*esDoc) {
+	if len(docs) == 0 {
+		return
+	}
+	if len(es.SpoolDirectory) == 0 {
+		es.metricstatus.WithLabelValues("Dropped").Add(float64(len(docs)))
+		return
+	}
+	var buf bytes.Buffer
+	for _, doc := range docs {
+		buf.Write(doc.meta)
+		buf.Write(doc.data)
+		buf.WriteByte('\n')
+	}
+	es.Lock()
+	defer es.Unlock()
+	if es.spoolSize+int64(buf.Len()) > es.SpoolMaxSize {
+		log.Println("elasticsearch spool is full")
+		es.metricstatus.WithLabelValues("Dropped").Add(float64(len(docs)))
+		return
+	}
+	es.spoolSeq++
+	name := fmt.Sprintf("seg-%020d-%06d.bulk", time.Now().UnixNano(), es.spoolSeq%1000000)
+	path := filepath.Join(es.SpoolDirectory, name)
+	err := ioutil.WriteFile(path+".tmp", buf.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Println("elasticsearch spool", err)
+		os.Remove(path + ".tmp")
+		es.metricstatus.WithLabelValues("Dropped").Add(float64(len(docs)))
+		return
+	}
+	es.segments = append(es.segments, name)
+	es.spoolSize += int64(buf.Len())
+	es.metricstatus.WithLabelValues("Spooled").Add(float64(len(docs)))
+}
+
+// readSegment parse bulk lines of segment to docs
+func readSegment(path string) ([]*esDoc, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var docs []*esDoc
+	reader := bufio.NewReader(f)
+	for {
+		meta, err := reader.ReadBytes('\n')
+		if len(meta) == 0 && err != nil {
+			break
+		}
+		data, err := reader.ReadBytes('\n')
+		if err != nil {
+			return docs, fmt.Errorf("truncated segment %s", path)
+		}
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := json.Unmarshal(meta, &action); err != nil {
+			return docs, err
+		}
+		doc := &esDoc{meta: meta, data: bytes.TrimRight(data, "\n")}
+		for _, v := range action {
+			doc.index, doc.id = v.Index, v.ID
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// replayLoop send segments in order when circuit is closed
+func (es *ElasticSearchWriter) replayLoop() {
+	defer es.loopWg.Done()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-es.exitChan:
+			return
+		case <-ticker.C:
+			for es.replay() {
+				select {
+				case <-es.exitChan:
+					return
+				default:
+				}
+			}
+		}
+	}
+}
+
+// replay send the oldest segment, return true if it is done
+func (es *ElasticSearchWriter) replay() bool {
+	es.Lock()
+	if len(es.segments) == 0 {
+		es.Unlock()
+		return false
+	}
+	name := es.segments[0]
+	es.Unlock()
+	if es.guard.IsOpen() {
+		return false
+	}
+	path := filepath.Join(es.SpoolDirectory, name)
+	docs, err := readSegment(path)
+	if err != nil {
+		log.Println("elasticsearch spool", err)
+		es.metricstatus.WithLabelValues("SpoolCorrupted").Inc()
+	}
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	for len(docs) > 0 {
+		var retry []*esDoc
+		err = es.guard.Try(func(ctx context.Context) error {
+			var err error
+			retry, err = es.bulk(ctx, docs)
+			return err
+		})
+		if err != nil {
+			log.Println("elasticsearch replay", name, err)
+			return false
+		}
+		docs = retry
+		if len(docs) > 0 {
+			// keep rejected items of 429/503 for next round
+			var buf bytes.Buffer
+			for _, doc := range docs {
+				buf.Write(doc.meta)
+				buf.Write(doc.data)
+				buf.WriteByte('\n')
+			}
+			if err = ioutil.WriteFile(path+".tmp", buf.Bytes(), 0644); err == nil {
+				err = os.Rename(path+".tmp", path)
+			}
+			if err == nil {
+				es.Lock()
+				es.spoolSize += int64(buf.Len()) - size
+				es.Unlock()
+				return false
+			}
+			log.Println("elasticsearch spool", err)
+		}
+		break
+	}
+	os.Remove(path)
+	es.Lock()
+	es.segments = es.segments[1:]
+	es.spoolSize -= size
+	es.Unlock()
+	es.metricstatus.WithLabelValues("Replayed").Inc()
+	return true
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// config
+// {
+// "IndexTemplate":"true",
+// "TemplateName":"nginxlog",
+// "TemplatePattern":"nginxlog-*",
+// "TextFields":"content,HttpUserAgent",
+// "GeoPointFields":"geoip.location",
+// "NumberOfShards":"3",
+// "NumberOfReplicas":"1",
+// "ILMPolicy":"nginxlog",
+// "ILMDeleteAfter":"30d",
+// "ILMRolloverSize":"50gb",
+// "ILMRolloverAge":"1d"
+// }
+// IndexTemplate put template for TemplatePattern (default IndexPerfix*) on start,
+// mapping come from LogParser TokenFormat:
+// int: long, float: double, nginxtimestamp and timestamp: date, string: keyword,
+// TextFields: text, GeoPointFields: geo_point
+// ILMPolicy is created if not exist, ILM for elasticsearch and ISM for opensearch,
+// rollover is only used for data stream
+
+// perform send request to cluster with the client of its version, return status and body
+func (es *ElasticSearchWriter) perform(method, path string, body []byte) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var res *http.Response
+	switch {
+	case es.es8Client != nil:
+		res, err = es.es8Client.Perform(req)
+	case es.es7Client != nil:
+		res, err = es.es7Client.Perform(req)
+	default:
+		res, err = es.esClient.Perform(req)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	return res.StatusCode, data, err
+}
+
+// setMapping set mapping of dotted field name to nested properties
+func setMapping(properties map[string]interface{}, name string, mapping map[string]interface{}) {
+	keys := strings.Split(name, ".")
+	for _, key := range keys[:len(keys)-1] {
+		object, _ := properties[key].(map[string]interface{})
+		nested, ok := object["properties"].(map[string]interface{})
+		if !ok {
+			nested = make(map[string]interface{})
+			properties[key] = map[string]interface{}{"properties": nested}
+		}
+		properties = nested
+	}
+	properties[keys[len(keys)-1]] = mapping
+}
+
+// templateMappings build mappings from parser schema
+func templateMappings(parser *LogParser, config map[string]string, timestampField string) map[string]interface{} {
+	properties := make(map[string]interface{})
+	schema := map[string]string{"timestamp": "time"}
+	if parser != nil {
+		schema = parser.Schema()
+	}
+	for name, format := range schema {
+		var mapping map[string]interface{}
+		switch format {
+		case "int":
+			mapping = map[string]interface{}{"type": "long"}
+		case "float":
+			mapping = map[string]interface{}{"type": "double"}
+		case "nginxtimestamp", "time":
+			mapping = map[string]interface{}{"type": "date"}
+		default:
+			mapping = map[string]interface{}{"type": "keyword", "ignore_above": 1024}
+		}
+		setMapping(properties, name, mapping)
+	}
+	setMapping(properties, timestampField, map[string]interface{}{"type": "date"})
+	setMapping(properties, "@timestamp", map[string]interface{}{"type": "date"})
+	for _, name := range splitKeys(config["TextFields"]) {
+		setMapping(properties, name, map[string]interface{}{
+			"type":   "text",
+			"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256}},
+		})
+	}
+	geoFields := config["GeoPointFields"]
+	if len(geoFields) == 0 {
+		geoFields = "geoip.location"
+	}
+	for _, name := range splitKeys(geoFields) {
+		setMapping(properties, name, map[string]interface{}{"type": "geo_point"})
+	}
+	return map[string]interface{}{
+		"dynamic_templates": []interface{}{
+			map[string]interface{}{
+				"strings_as_keyword": map[string]interface{}{
+					"match_mapping_type": "string",
+					"mapping":            map[string]interface{}{"type": "keyword", "ignore_above": 1024},
+				},
+			},
+		},
+		"properties": properties,
+	}
+}
+
+// bootstrap ensure ilm/ism policy and index template
+func (es *ElasticSearchWriter) bootstrap(config map[string]string, parser *LogParser) error {
+	pattern := config["TemplatePattern"]
+	if len(pattern) == 0 {
+		pattern = es.IndexPerfix + "*"
+	}
+	policy := config["ILMPolicy"]
+	if len(policy) > 0 {
+		if err := es.ensurePolicy(policy, pattern, config); err != nil {
+			return err
+		}
+	}
+	if config["IndexTemplate"] != "true" {
+		return nil
+	}
+	name := config["TemplateName"]
+	if len(name) == 0 {
+		name = es.IndexPerfix
+	}
+	settings := make(map[string]interface{})
+	if shards, err := strconv.Atoi(config["NumberOfShards"]); err == nil && shards > 0 {
+		settings["index.number_of_shards"] = shards
+	}
+	if replicas, err := strconv.Atoi(config["NumberOfReplicas"]); err == nil && replicas >= 0 {
+		settings["index.number_of_replicas"] = replicas
+	}
+	if len(policy) > 0 && es.Distribution == "elasticsearch" {
+		settings["index.lifecycle.name"] = policy
+	}
+	mappings := templateMappings(parser, config, es.TimestampField)
+	var path string
+	var body map[string]interface{}
+	switch {
+	case es.esVersion > 7 || es.esVersion == 7 && es.esMinorVersion >= 8:
+		// composable template
+		path = "/_index_template/" + name
+		body = map[string]interface{}{
+			"index_patterns": []string{pattern},
+			"priority":       200,
+			"template": map[string]interface{}{
+				"settings": settings,
+				"mappings": mappings,
+			},
+		}
+		if es.DataStream {
+			body["data_stream"] = map[string]interface{}{}
+		}
+	case es.esVersion == 7:
+		path = "/_template/" + name
+		body = map[string]interface{}{
+			"index_patterns": []string{pattern},
+			"settings":       settings,
+			"mappings":       mappings,
+		}
+	default:
+		path = "/_template/" + name
+		body = map[string]interface{}{
+			"index_patterns": []string{pattern},
+			"settings":       settings,
+			"mappings":       map[string]interface{}{es.Type: mappings},
+		}
+	}
+	data, _ := json.Marshal(body)
+	status, rsp, err := es.perform("PUT", path, data)
+	if err != nil {
+		return err
+	}
+	if status > 299 {
+		return fmt.Errorf("put template %s: [%d] %s", name, status, rsp)
+	}
+	log.Println("put elasticsearch template", name, pattern)
+	return nil
+}
+
+// ensurePolicy create ilm (elasticsearch) or ism (opensearch) policy if not exist
+func (es *ElasticSearchWriter) ensurePolicy(name, pattern string, config map[string]string) error {
+	deleteAfter := config["ILMDeleteAfter"]
+	if len(deleteAfter) == 0 {
+		deleteAfter = "30d"
+	}
+	var path string
+	var body map[string]interface{}
+	if es.Distribution == "opensearch" {
+		path = "/_plugins/_ism/policies/" + name
+		body = map[string]interface{}{
+			"policy": map[string]interface{}{
+				"description":   "lazy " + es.IndexPerfix,
+				"default_state": "hot",
+				"states": []interface{}{
+					map[string]interface{}{
+						"name":    "hot",
+						"actions": []interface{}{},
+						"transitions": []interface{}{
+							map[string]interface{}{
+								"state_name": "delete",
+								"conditions": map[string]interface{}{"min_index_age": deleteAfter},
+							},
+						},
+					},
+					map[string]interface{}{
+						"name":        "delete",
+						"actions":     []interface{}{map[string]interface{}{"delete": map[string]interface{}{}}},
+						"transitions": []interface{}{},
+					},
+				},
+				"ism_template": []interface{}{
+					map[string]interface{}{"index_patterns": []string{pattern}, "priority": 100},
+				},
+			},
+		}
+	} else {
+		if es.esVersion == 6 && es.esMinorVersion < 6 {
+			return fmt.Errorf("ilm need elasticsearch 6.6+")
+		}
+		path = "/_ilm/policy/" + name
+		hot := map[string]interface{}{}
+		if es.DataStream {
+			rollover := map[string]interface{}{}
+			if size := config["ILMRolloverSize"]; len(size) > 0 {
+				rollover["max_size"] = size
+			}
+			if age := config["ILMRolloverAge"]; len(age) > 0 {
+				rollover["max_age"] = age
+			}
+			if len(rollover) > 0 {
+				hot["rollover"] = rollover
+			}
+		}
+		body = map[string]interface{}{
+			"policy": map[string]interface{}{
+				"phases": map[string]interface{}{
+					"hot": map[string]interface{}{"min_age": "0ms", "actions": hot},
+					"delete": map[string]interface{}{
+						"min_age": deleteAfter,
+						"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+					},
+				},
+			},
+		}
+	}
+	status, rsp, err := es.perform("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusOK {
+		return nil
+	}
+	if status != http.StatusNotFound {
+		return fmt.Errorf("get policy %s: [%d] %s", name, status, rsp)
+	}
+	data, _ := json.Marshal(body)
+	status, rsp, err = es.perform("PUT", path, data)
+	if err != nil {
+		return err
+	}
+	if status > 299 {
+		return fmt.Errorf("put policy %s: [%d] %s", name, status, rsp)
+	}
+	log.Println("put elasticsearch policy", name)
+	return nil
+}
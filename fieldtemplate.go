@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FieldTemplate string template with {field} placeholders
+// nginx-{Host} or devices/{geoip.country_code2}/{deviceid}
+type FieldTemplate struct {
+	Template string
+	parts    []string
+	isField  []bool
+}
+
+// NewFieldTemplate create FieldTemplate
+func NewFieldTemplate(template string) *FieldTemplate {
+	t := &FieldTemplate{Template: template}
+	for len(template) > 0 {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, template[:start])
+			t.isField = append(t.isField, false)
+		}
+		t.parts = append(t.parts, template[start+1:start+end])
+		t.isField = append(t.isField, true)
+		template = template[start+end+1:]
+	}
+	if len(template) > 0 {
+		t.parts = append(t.parts, template)
+		t.isField = append(t.isField, false)
+	}
+	return t
+}
+
+// Fields return field names used in template
+func (t *FieldTemplate) Fields() []string {
+	var fields []string
+	for i, part := range t.parts {
+		if t.isField[i] {
+			fields = append(fields, part)
+		}
+	}
+	return fields
+}
+
+// Render replace placeholders by msg fields, missing fields are empty
+func (t *FieldTemplate) Render(msg *map[string]interface{}) string {
+	return t.RenderFunc(func(name string) (string, bool) {
+		return LookupField(msg, name)
+	})
+}
+
+// RenderFunc replace placeholders by lookup result
+func (t *FieldTemplate) RenderFunc(lookup func(name string) (string, bool)) string {
+	var b strings.Builder
+	for i, part := range t.parts {
+		if !t.isField[i] {
+			b.WriteString(part)
+			continue
+		}
+		if value, ok := lookup(part); ok {
+			b.WriteString(value)
+		}
+	}
+	return b.String()
+}
+
+// RenderTime replace placeholders by msg fields and strftime
+// directives in the literal parts by t, nginx-{Host}-%Y.%m.%d
+func (t *FieldTemplate) RenderTime(msg *map[string]interface{}, ts time.Time) string {
+	return t.RenderTimeFunc(func(name string) (string, bool) {
+		return LookupField(msg, name)
+	}, ts)
+}
+
+// RenderTimeFunc replace placeholders by lookup result and strftime directives by t
+func (t *FieldTemplate) RenderTimeFunc(lookup func(name string) (string, bool), ts time.Time) string {
+	var b strings.Builder
+	for i, part := range t.parts {
+		if !t.isField[i] {
+			b.WriteString(Strftime(part, ts))
+			continue
+		}
+		if value, ok := lookup(part); ok {
+			b.WriteString(value)
+		}
+	}
+	return b.String()
+}
+
+// Strftime format time with %Y %y %m %d %H %M %S %j %V %G %b %B %a %A %z %Z %s %%
+func Strftime(format string, t time.Time) string {
+	if !strings.Contains(format, "%") {
+		return format
+	}
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'M':
+			b.WriteString(t.Format("04"))
+		case 'S':
+			b.WriteString(t.Format("05"))
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'V':
+			_, week := t.ISOWeek()
+			fmt.Fprintf(&b, "%02d", week)
+		case 'G':
+			year, _ := t.ISOWeek()
+			fmt.Fprintf(&b, "%04d", year)
+		case 'b':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case 's':
+			fmt.Fprintf(&b, "%d", t.Unix())
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+	}
+	return b.String()
+}
+
+// LookupField get field as string, geoip.city_name read nested map
+func LookupField(msg *map[string]interface{}, name string) (string, bool) {
+	value, ok := LookupValue(msg, name)
+	if !ok {
+		return "", false
+	}
+	return FormatValue(value), true
+}
+
+// LookupValue get field value, geoip.city_name read nested map
+func LookupValue(msg *map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := (*msg)[name]; ok {
+		return value, true
+	}
+	keys := strings.Split(name, ".")
+	var current interface{} = *msg
+	for _, key := range keys {
+		var value interface{}
+		var ok bool
+		switch m := current.(type) {
+		case map[string]interface{}:
+			value, ok = m[key]
+		case map[string]string:
+			value, ok = m[key]
+		case map[string]float64:
+			value, ok = m[key]
+		}
+		if !ok {
+			return nil, false
+		}
+		current = value
+	}
+	return current, true
+}
+
+// FormatValue convert field value to string
+func FormatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStrftime(t *testing.T) {
+	ts := time.Date(2019, time.March, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"nginx", "nginx"},
+		{"%Y.%m.%d", "2019.03.04"},
+		{"%y%m%d-%H%M%S", "190304-050607"},
+		{"%j", "063"},
+		{"%G-w%V", "2019-w10"},
+		{"%b %B %a %A", "Mar March Mon Monday"},
+		{"%z %Z", "+0000 UTC"},
+		{"%s", "1551675967"},
+		{"100%%", "100%"},
+		{"%q", "%q"},
+		{"end%", "end%"},
+	}
+	for _, tt := range tests {
+		if got := Strftime(tt.format, ts); got != tt.want {
+			t.Errorf("Strftime(%q) = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestFieldTemplate(t *testing.T) {
+	msg := &map[string]interface{}{
+		"Host":  "web1",
+		"count": 3,
+		"geoip": map[string]interface{}{"country_code2": "CN"},
+	}
+	tests := []struct {
+		template string
+		fields   []string
+		want     string
+	}{
+		{"nginx", nil, "nginx"},
+		{"nginx-{Host}", []string{"Host"}, "nginx-web1"},
+		{"{Host}", []string{"Host"}, "web1"},
+		{"devices/{geoip.country_code2}/{count}", []string{"geoip.country_code2", "count"}, "devices/CN/3"},
+		{"a-{missing}-b", []string{"missing"}, "a--b"},
+		{"open-{Host", nil, "open-{Host"},
+	}
+	for _, tt := range tests {
+		ft := NewFieldTemplate(tt.template)
+		if got := ft.Fields(); !reflect.DeepEqual(got, tt.fields) {
+			t.Errorf("%q Fields() = %v, want %v", tt.template, got, tt.fields)
+		}
+		if got := ft.Render(msg); got != tt.want {
+			t.Errorf("%q Render() = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestFieldTemplateRenderTime(t *testing.T) {
+	msg := &map[string]interface{}{"Host": "web%Y"}
+	ts := time.Date(2019, time.March, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"nginx-{Host}-%Y.%m.%d", "nginx-web%Y-2019.03.04"},
+		{"%Y/%m/{Host}", "2019/03/web%Y"},
+		{"logs-%H{missing}", "logs-05"},
+	}
+	for _, tt := range tests {
+		if got := NewFieldTemplate(tt.template).RenderTime(msg, ts); got != tt.want {
+			t.Errorf("%q RenderTime() = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
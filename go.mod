@@ -2,7 +2,6 @@ module lazy
 
 require (
 	github.com/Shopify/sarama v1.24.1
-	github.com/afex/hystrix-go v0.0.0-20180502004556-fa1af6a1f4f5
 	github.com/asergeyev/nradix v0.0.0-20170505151046-3872ab85bb56 // indirect
 	github.com/bsm/sarama-cluster v2.1.15+incompatible
 	github.com/eclipse/paho.mqtt.golang v1.2.0
@@ -10,11 +9,14 @@ require (
 	github.com/elastic/go-elasticsearch/v6 v6.7.0
 	github.com/elastic/go-elasticsearch/v7 v7.4.1
 	github.com/elastic/go-elasticsearch/v8 v8.0.0-20191112174903-8e2b6095b305
+	github.com/go-sql-driver/mysql v1.4.1
 	github.com/golang/protobuf v1.3.2
+	github.com/golang/snappy v0.0.1
 	github.com/gorgonia/parser v0.0.0-20180406090024-6baefca1d828 // indirect
 	github.com/hashicorp/consul/api v1.2.0
 	github.com/jbrukh/bayesian v0.0.0-20190218043818-13a316171413
 	github.com/jeromer/syslogparser v0.0.0-20190429161531-5fbaaf06d9e7
+	github.com/lib/pq v1.2.0
 	github.com/mailru/easyjson v0.7.0 // indirect
 	github.com/nsqio/go-nsq v1.0.7
 	github.com/olivere/elastic v6.2.26+incompatible
@@ -23,6 +25,8 @@ require (
 	github.com/owulveryck/lstm v0.0.0-20180406085902-1581884e9d2d
 	github.com/prometheus/client_golang v1.2.1
 	github.com/smartystreets/goconvey v1.6.4 // indirect
+	github.com/xitongsys/parquet-go v1.5.1
+	github.com/xitongsys/parquet-go-source v0.0.0-20190524061010-2b72cbee77d5
 	github.com/zmap/go-iptree v0.0.0-20170831022036-1948b1097e25
 	gorgonia.org/gorgonia v0.9.4 // indirect
 	gorgonia.org/tensor v0.9.2 // indirect
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// config
+// {
+// "URL":"https://cmdb.example.com/api/events",
+// "Method":"POST",
+// "BodyFormat":"ndjson",
+// "Template":"{{range .}}{{.Host}} {{.Status}}\n{{end}}",
+// "ContentType":"text/plain",
+// "Headers":"X-Source: lazy,X-Env: prod",
+// "UserName":"",
+// "Password":"",
+// "BearerToken":"",
+// "BearerTokenFile":"/etc/lazy/token",
+// "Compression":"gzip",
+// "BatchSize":"500",
+// "FlushInterval":"1000",
+// "MaxRetry":"5",
+// "Timeout":"10000",
+// "Type":"http"
+// }
+// BodyFormat ndjson, json (array) or template, template is executed with the batch
+// network errors, 429 and 5xx are retried by SinkGuard, Retry-After is honored
+
+// HTTPWriter post msg batch to http endpoint
+type HTTPWriter struct {
+	URL           string
+	Method        string
+	BodyFormat    string
+	ContentType   string
+	Headers       map[string]string
+	UserName      string
+	Password      string
+	BearerToken   string
+	Compression   string
+	BatchSize     int
+	FlushInterval int
+	template      *template.Template
+	guard         *SinkGuard
+	client        *http.Client
+	wg            sinkWaitGroup
+	exitChan      chan int
+	metricstatus  *prometheus.CounterVec
+}
+
+// NewHTTPWriter create HTTPWriter
+func NewHTTPWriter(config map[string]string) (*HTTPWriter, error) {
+	w := &HTTPWriter{
+		URL:         config["URL"],
+		Method:      strings.ToUpper(config["Method"]),
+		BodyFormat:  config["BodyFormat"],
+		ContentType: config["ContentType"],
+		UserName:    config["UserName"],
+		Password:    config["Password"],
+		BearerToken: config["BearerToken"],
+		Compression: config["Compression"],
+	}
+	if len(w.URL) == 0 {
+		return w, fmt.Errorf("no http url")
+	}
+	if w.Method != "PUT" {
+		w.Method = "POST"
+	}
+	var err error
+	switch w.BodyFormat {
+	case "json":
+		if len(w.ContentType) == 0 {
+			w.ContentType = "application/json"
+		}
+	case "template":
+		w.template, err = template.New("body").Parse(config["Template"])
+		if err != nil {
+			return w, err
+		}
+		if len(w.ContentType) == 0 {
+			w.ContentType = "text/plain"
+		}
+	default:
+		w.BodyFormat = "ndjson"
+		if len(w.ContentType) == 0 {
+			w.ContentType = "application/x-ndjson"
+		}
+	}
+	w.Headers = make(map[string]string)
+	for _, header := range strings.Split(config["Headers"], ",") {
+		items := strings.SplitN(header, ":", 2)
+		if len(items) == 2 {
+			w.Headers[strings.TrimSpace(items[0])] = strings.TrimSpace(items[1])
+		}
+	}
+	if len(config["BearerTokenFile"]) > 0 {
+		token, err := ioutil.ReadFile(config["BearerTokenFile"])
+		if err != nil {
+			return w, err
+		}
+		w.BearerToken = strings.TrimSpace(string(token))
+	}
+	w.BatchSize, err = strconv.Atoi(config["BatchSize"])
+	if err != nil || w.BatchSize < 1 {
+		w.BatchSize = 500
+	}
+	w.FlushInterval, err = strconv.Atoi(config["FlushInterval"])
+	if err != nil || w.FlushInterval < 100 {
+		w.FlushInterval = 1000
+	}
+	timeout, err := strconv.Atoi(config["Timeout"])
+	if err != nil || timeout < 1000 {
+		timeout = 10000
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if strings.HasPrefix(w.URL, "https") {
+		transport.TLSClientConfig, err = NewTLSConfig(config)
+		if err != nil {
+			return w, err
+		}
+	}
+	w.client = &http.Client{Transport: transport, Timeout: time.Duration(timeout) * time.Millisecond}
+	w.exitChan = make(chan int)
+	w.metricstatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "lazy_output",
+			Name:      fmt.Sprintf("http_writer_%s", config["Taskname"]),
+			Help:      "http writer status.",
+		},
+		[]string{"method"},
+	)
+	// Register status
+	prometheus.Register(w.metricstatus)
+	w.guard = NewSinkGuard("http", config)
+	return w, nil
+}
+
+// Stop close all
+func (w *HTTPWriter) Stop() {
+	close(w.exitChan)
+	w.wg.Wait()
+	w.guard.Close()
+	log.Println("exit http writer")
+	prometheus.Unregister(w.metricstatus)
+}
+
+// Start run writer
+func (w *HTTPWriter) Start(dataChan chan *map[string]interface{}) {
+	if !w.wg.Add() {
+		return
+	}
+	defer w.wg.Done()
+	var batch []*map[string]interface{}
+	ticker := time.NewTicker(time.Duration(w.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.exitChan:
+			w.send(batch)
+			return
+		case <-ticker.C:
+			w.send(batch)
+			batch = batch[:0]
+		case logmsg := <-dataChan:
+			batch = append(batch, logmsg)
+			if len(batch) >= w.BatchSize {
+				w.send(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+func (w *HTTPWriter) encode(batch []*map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer io.Writer = &buf
+	var zw *gzip.Writer
+	if w.Compression == "gzip" {
+		zw = gzip.NewWriter(&buf)
+		writer = zw
+	}
+	switch w.BodyFormat {
+	case "json":
+		if err := json.NewEncoder(writer).Encode(batch); err != nil {
+			return nil, err
+		}
+	case "template":
+		if err := w.template.Execute(writer, batch); err != nil {
+			return nil, err
+		}
+	default:
+		encoder := json.NewEncoder(writer)
+		for _, msg := range batch {
+			if err := encoder.Encode(msg); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// send post batch through SinkGuard
+func (w *HTTPWriter) send(batch []*map[string]interface{}) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := w.encode(batch)
+	if err != nil {
+		log.Println("http writer encode", err)
+		w.metricstatus.WithLabelValues("encode_failed").Add(float64(len(batch)))
+		return
+	}
+	if err = w.guard.Do(func(ctx context.Context) error {
+		return w.post(ctx, body)
+	}); err != nil {
+		log.Println("http writer", err)
+		w.metricstatus.WithLabelValues("failed").Add(float64(len(batch)))
+		return
+	}
+	w.metricstatus.WithLabelValues("sent").Add(float64(len(batch)))
+}
+
+// post body once, 4xx except 429 is permanent
+func (w *HTTPWriter) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, w.Method, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", w.ContentType)
+	if w.Compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	if len(w.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+w.BearerToken)
+	} else if len(w.UserName) > 0 {
+		req.SetBasicAuth(w.UserName, w.Password)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	res.Body.Close()
+	if res.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("[%d] %s", res.StatusCode, msg)
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode < 500 {
+		return Permanent(err)
+	}
+	if seconds, e := strconv.Atoi(res.Header.Get("Retry-After")); e == nil && seconds > 0 {
+		return RetryAfter(err, time.Duration(seconds)*time.Second)
+	}
+	return err
+}
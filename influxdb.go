@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// config
+// {
+// "URL":"http://127.0.0.1:8086",
+// "APIVersion":"1",
+// "Database":"lazy",
+// "RetentionPolicy":"autogen",
+// "UserName":"xxx",
+// "Password":"xxx",
+// "Org":"ops",
+// "Bucket":"lazy",
+// "Token":"xxxx",
+// "Measurement":"nginx",
+// "TagKeys":"Host,Status",
+// "FieldKeys":"RequestTime,BodyBytesSent",
+// "TimestampField":"timestamp",
+// "Precision":"ms",
+// "BatchSize":"1000",
+// "FlushInterval":"1000",
+// "MaxRetry":"3",
+// "Timeout":"5000",
+// "Type":"influxdb"
+// }
+// APIVersion 1 write to /write with Database, 2 write to /api/v2/write with Org/Bucket/Token
+// Measurement can use {field} placeholders
+
+// InfluxDBWriter influxdb line protocol writer
+type InfluxDBWriter struct {
+	writeURL       string
+	UserName       string
+	Password       string
+	Token          string
+	measurement    *FieldTemplate
+	TagKeys        []string
+	FieldKeys      []string
+	TimestampField string
+	Precision      string
+	BatchSize      int
+	FlushInterval  int
+	guard          *SinkGuard
+	client         *http.Client
+	wg             sinkWaitGroup
+	exitChan       chan int
+	metricstatus   *prometheus.CounterVec
+}
+
+// NewInfluxDBWriter create InfluxDBWriter
+func NewInfluxDBWriter(config map[string]string) (*InfluxDBWriter, error) {
+	w := &InfluxDBWriter{
+		UserName:       config["UserName"],
+		Password:       config["Password"],
+		Token:          config["Token"],
+		TimestampField: config["TimestampField"],
+		Precision:      config["Precision"],
+	}
+	if len(config["Measurement"]) == 0 {
+		return w, fmt.Errorf("no measurement")
+	}
+	w.measurement = NewFieldTemplate(config["Measurement"])
+	w.TagKeys = splitKeys(config["TagKeys"])
+	w.FieldKeys = splitKeys(config["FieldKeys"])
+	if len(w.FieldKeys) == 0 {
+		return w, fmt.Errorf("no field keys")
+	}
+	if len(w.TimestampField) == 0 {
+		w.TimestampField = "timestamp"
+	}
+	switch w.Precision {
+	case "ns", "us", "ms", "s":
+	default:
+		w.Precision = "ms"
+	}
+	var err error
+	w.BatchSize, err = strconv.Atoi(config["BatchSize"])
+	if err != nil || w.BatchSize < 1 {
+		w.BatchSize = 1000
+	}
+	w.FlushInterval, err = strconv.Atoi(config["FlushInterval"])
+	if err != nil || w.FlushInterval < 100 {
+		w.FlushInterval = 1000
+	}
+	timeout, err := strconv.Atoi(config["Timeout"])
+	if err != nil || timeout < 1000 {
+		timeout = 5000
+	}
+	params := url.Values{}
+	params.Set("precision", w.Precision)
+	endpoint := strings.TrimRight(config["URL"], "/")
+	if config["APIVersion"] == "2" {
+		params.Set("org", config["Org"])
+		params.Set("bucket", config["Bucket"])
+		w.writeURL = fmt.Sprintf("%s/api/v2/write?%s", endpoint, params.Encode())
+	} else {
+		params.Set("db", config["Database"])
+		if len(config["RetentionPolicy"]) > 0 {
+			params.Set("rp", config["RetentionPolicy"])
+		}
+		w.writeURL = fmt.Sprintf("%s/write?%s", endpoint, params.Encode())
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if strings.HasPrefix(endpoint, "https") {
+		transport.TLSClientConfig, err = NewTLSConfig(config)
+		if err != nil {
+			return w, err
+		}
+	}
+	w.client = &http.Client{Transport: transport, Timeout: time.Duration(timeout) * time.Millisecond}
+	w.exitChan = make(chan int)
+	w.metricstatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "lazy_output",
+			Name:      fmt.Sprintf("influxdb_writer_%s", config["Taskname"]),
+			Help:      "influxdb writer status.",
+		},
+		[]string{"method"},
+	)
+	// Register status
+	prometheus.Register(w.metricstatus)
+	w.guard = NewSinkGuard("influxdb", guardConfig(config, map[string]string{"RetryBackoff": "1000"}))
+	return w, nil
+}
+
+func splitKeys(keys string) []string {
+	var list []string
+	for _, k := range strings.Split(keys, ",") {
+		k = strings.TrimSpace(k)
+		if len(k) > 0 {
+			list = append(list, k)
+		}
+	}
+	return list
+}
+
+// Stop close all
+func (w *InfluxDBWriter) Stop() {
+	close(w.exitChan)
+	w.wg.Wait()
+	w.guard.Close()
+	log.Println("exit influxdb writer")
+	prometheus.Unregister(w.metricstatus)
+}
+
+// Start run writer
+func (w *InfluxDBWriter) Start(dataChan chan *map[string]interface{}) {
+	if !w.wg.Add() {
+		return
+	}
+	defer w.wg.Done()
+	var buf bytes.Buffer
+	count := 0
+	ticker := time.NewTicker(time.Duration(w.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.exitChan:
+			w.write(buf.Bytes(), count)
+			return
+		case <-ticker.C:
+			w.write(buf.Bytes(), count)
+			buf.Reset()
+			count = 0
+		case logmsg := <-dataChan:
+			line, ok := w.lineProtocol(logmsg)
+			if !ok {
+				w.metricstatus.WithLabelValues("skipped").Inc()
+				break
+			}
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+			count++
+			if count >= w.BatchSize {
+				w.write(buf.Bytes(), count)
+				buf.Reset()
+				count = 0
+			}
+		}
+	}
+}
+
+// lineProtocol convert msg to measurement,tags fields timestamp
+func (w *InfluxDBWriter) lineProtocol(msg *map[string]interface{}) (string, bool) {
+	var b strings.Builder
+	b.WriteString(influxEscape(w.measurement.Render(msg), ", "))
+	tags := make([]string, 0, len(w.TagKeys))
+	for _, k := range w.TagKeys {
+		value, ok := LookupField(msg, k)
+		if !ok || len(value) == 0 {
+			continue
+		}
+		tags = append(tags, fmt.Sprintf("%s=%s", influxEscape(k, ",= "), influxEscape(value, ",= ")))
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		b.WriteByte(',')
+		b.WriteString(tag)
+	}
+	fields := 0
+	for _, k := range w.FieldKeys {
+		value, ok := LookupValue(msg, k)
+		if !ok {
+			continue
+		}
+		if fields == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(influxEscape(k, ",= "))
+		b.WriteByte('=')
+		b.WriteString(influxFieldValue(value))
+		fields++
+	}
+	if fields == 0 {
+		return "", false
+	}
+	if ts, ok := (*msg)[w.TimestampField].(time.Time); ok {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(w.timestamp(ts), 10))
+	}
+	return b.String(), true
+}
+
+func (w *InfluxDBWriter) timestamp(ts time.Time) int64 {
+	switch w.Precision {
+	case "ns":
+		return ts.UnixNano()
+	case "us":
+		return ts.UnixNano() / int64(time.Microsecond)
+	case "s":
+		return ts.Unix()
+	default:
+		return ts.UnixNano() / int64(time.Millisecond)
+	}
+}
+
+func influxEscape(s string, chars string) string {
+	if !strings.ContainsAny(s, chars+"\\") {
+		return s
+	}
+	var b strings.Builder
+	for _, c := range s {
+		if c == '\\' || strings.ContainsRune(chars, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func influxFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case int:
+		return strconv.FormatInt(int64(v), 10) + "i"
+	case int32:
+		return strconv.FormatInt(int64(v), 10) + "i"
+	case int64:
+		return strconv.FormatInt(v, 10) + "i"
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		s := strings.Replace(FormatValue(v), `\`, `\\`, -1)
+		return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+	}
+}
+
+// write post lines to influxdb through SinkGuard
+func (w *InfluxDBWriter) write(body []byte, count int) {
+	if count == 0 {
+		return
+	}
+	if err := w.guard.Do(func(ctx context.Context) error {
+		return w.post(ctx, body)
+	}); err != nil {
+		log.Println("influxdb write", err)
+		w.metricstatus.WithLabelValues("failed").Add(float64(count))
+		return
+	}
+	w.metricstatus.WithLabelValues("written").Add(float64(count))
+}
+
+// post body once, 4xx except 429 is permanent
+func (w *InfluxDBWriter) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(w.Token) > 0 {
+		req.Header.Set("Authorization", "Token "+w.Token)
+	} else if len(w.UserName) > 0 {
+		req.SetBasicAuth(w.UserName, w.Password)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	res.Body.Close()
+	if res.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("influxdb write error: [%d] %s", res.StatusCode, msg)
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode < 500 {
+		return Permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInfluxEscape(t *testing.T) {
+	tests := []struct {
+		value string
+		chars string
+		want  string
+	}{
+		{"cpu", ", ", "cpu"},
+		{"cpu load", ", ", `cpu\ load`},
+		{"a,b", ", ", `a\,b`},
+		{"k=v", ",= ", `k\=v`},
+		{`c:\temp`, ",= ", `c:\\temp`},
+		{"a=b, c", ",= ", `a\=b\,\ c`},
+		{"a=b", ", ", "a=b"},
+	}
+	for _, tt := range tests {
+		if got := influxEscape(tt.value, tt.chars); got != tt.want {
+			t.Errorf("influxEscape(%q, %q) = %q, want %q", tt.value, tt.chars, got, tt.want)
+		}
+	}
+}
+
+func TestInfluxFieldValue(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{1, "1i"},
+		{int64(-2), "-2i"},
+		{int32(3), "3i"},
+		{1.5, "1.5"},
+		{float32(0.25), "0.25"},
+		{true, "true"},
+		{"ok", `"ok"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`c:\temp`, `"c:\\temp"`},
+	}
+	for _, tt := range tests {
+		if got := influxFieldValue(tt.value); got != tt.want {
+			t.Errorf("influxFieldValue(%v) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestInfluxDBLineProtocol(t *testing.T) {
+	ts := time.Date(2019, time.March, 4, 5, 6, 7, 0, time.UTC)
+	w := &InfluxDBWriter{
+		measurement:    NewFieldTemplate("nginx {tag}"),
+		TagKeys:        []string{"host", "region"},
+		FieldKeys:      []string{"status", "size", "path"},
+		TimestampField: "timestamp",
+		Precision:      "s",
+	}
+	tests := []struct {
+		msg  map[string]interface{}
+		want string
+		ok   bool
+	}{
+		{
+			map[string]interface{}{"tag": "access", "host": "web 1", "region": "cn,bj", "status": 200, "size": 1.5, "path": "/a b", "timestamp": ts},
+			`nginx\ access,host=web\ 1,region=cn\,bj status=200i,size=1.5,path="/a b" 1551675967`,
+			true,
+		},
+		{
+			map[string]interface{}{"tag": "access", "host": "", "status": 404},
+			`nginx\ access status=404i`,
+			true,
+		},
+		{
+			map[string]interface{}{"tag": "access", "host": "web1"},
+			"",
+			false,
+		},
+	}
+	for _, tt := range tests {
+		got, ok := w.lineProtocol(&tt.msg)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("lineProtocol(%v) = %q, %v, want %q, %v", tt.msg, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
@@ -17,6 +18,8 @@ import (
 // "KafkaBrokers":"127.0.0.1:9200,172.17.0.1:9200",
 // "Topics":"xxx,xxx,xxx",
 // "ConsumerGroup":"test",
+// "MessageFormat":"protobuf",
+// "OffsetField":"offset",
 // "User":"",
 // "Password":"",
 // "Type":"kafka"
@@ -25,6 +28,8 @@ import (
 // KafkaReader reader
 type KafkaReader struct {
 	consumer     *cluster.Consumer
+	msgFormat    string
+	offsetField  string
 	exitChan     chan int
 	msgChan      chan *map[string][]byte
 	metricstatus *prometheus.CounterVec
@@ -35,6 +40,8 @@ func NewKafkaReader(config map[string]string) (*KafkaReader, error) {
 	m := &KafkaReader{}
 	m.msgChan = make(chan *map[string][]byte)
 	m.exitChan = make(chan int)
+	m.msgFormat = config["MessageFormat"]
+	m.offsetField = config["OffsetField"]
 	brokers := strings.Split(config["KafkaBrokers"], ",")
 	topics := strings.Split(config["Topics"], ",")
 	kafkaConfig := cluster.NewConfig()
@@ -95,8 +102,17 @@ func (m *KafkaReader) ReadLoop() {
 		select {
 		case msg, ok := <-m.consumer.Messages():
 			if ok {
-				logmsg := make(map[string][]byte)
-				logmsg["msg"] = msg.Value
+				logmsg, err := DecodeLogMsg(m.msgFormat, msg.Value)
+				if err != nil {
+					log.Println("decode", m.msgFormat, err)
+					m.consumer.MarkOffset(msg, "")
+					m.metricstatus.WithLabelValues("decode_failed").Inc()
+					break
+				}
+				if len(m.offsetField) > 0 {
+					// topic/partition/offset identify the source message
+					logmsg[m.offsetField] = []byte(fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset))
+				}
 				m.msgChan <- &logmsg
 				m.consumer.MarkOffset(msg, "")
 				m.metricstatus.WithLabelValues("message_count").Inc()
@@ -135,6 +151,10 @@ func (m *KafkaReader) GetMsgChan() chan *map[string][]byte {
 type KafkaWriter struct {
 	producer     sarama.AsyncProducer
 	Topic        string
+	guard        *SinkGuard
+	retryChan    chan *sarama.ProducerMessage
+	wg           sinkWaitGroup
+	resultWg     sync.WaitGroup
 	exitChan     chan int
 	metricstatus *prometheus.CounterVec
 }
@@ -150,6 +170,12 @@ func NewKafkaWriter(config map[string]string) (*KafkaWriter, error) {
 	}
 	kafkaConfig := sarama.NewConfig()
 	kafkaConfig.Producer.RequiredAcks = sarama.WaitForLocal
+	kafkaConfig.Producer.Return.Successes = true
+	kafkaWriter.guard = NewSinkGuard("kafka", config)
+	kafkaWriter.retryChan = make(chan *sarama.ProducerMessage)
+	if kafkaWriter.guard.AttemptTimeout > 0 {
+		kafkaConfig.Producer.Timeout = kafkaWriter.guard.AttemptTimeout
+	}
 	switch config["CompressionType"] {
 	case "snappy":
 		kafkaConfig.Producer.Compression = sarama.CompressionSnappy
@@ -177,6 +203,7 @@ func NewKafkaWriter(config map[string]string) (*KafkaWriter, error) {
 	}
 	kafkaWriter.producer, err = sarama.NewAsyncProducer(strings.Split(config["KafkaBrokers"], ","), kafkaConfig)
 	if err != nil {
+		kafkaWriter.guard.Close()
 		return kafkaWriter, err
 	}
 	kafkaWriter.metricstatus = prometheus.NewCounterVec(
@@ -189,30 +216,114 @@ func NewKafkaWriter(config map[string]string) (*KafkaWriter, error) {
 	)
 	// Register status
 	prometheus.Register(kafkaWriter.metricstatus)
+	kafkaWriter.results()
 	return kafkaWriter, err
 }
 
 // Stop writer tasks
 func (kafkaWriter *KafkaWriter) Stop() {
 	close(kafkaWriter.exitChan)
+	kafkaWriter.wg.Wait()
+	kafkaWriter.producer.Close()
+	kafkaWriter.resultWg.Wait()
+	log.Println("exit kafka producer")
+	kafkaWriter.guard.Close()
 	prometheus.Unregister(kafkaWriter.metricstatus)
 }
 
 // Start run writer
+// input is paused while circuit is open, failed msg is resent up to MaxRetry
 func (kafkaWriter *KafkaWriter) Start(dataChan chan *map[string]interface{}) {
+	if !kafkaWriter.wg.Add() {
+		return
+	}
+	defer kafkaWriter.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-kafkaWriter.exitChan:
-			kafkaWriter.producer.Close()
-			log.Println("exit kafka producer")
 			return
+		case <-ticker.C:
 		case logmsg := <-dataChan:
-			kafkaWriter.producer.Input() <- &sarama.ProducerMessage{Topic: kafkaWriter.Topic, Key: nil, Value: sarama.StringEncoder((*logmsg)["rawmsg"].(string))}
+			kafkaWriter.send(&sarama.ProducerMessage{Topic: kafkaWriter.Topic, Key: nil, Value: sarama.StringEncoder((*logmsg)["rawmsg"].(string))})
 			kafkaWriter.metricstatus.WithLabelValues("message_count").Inc()
-		case err := <-kafkaWriter.producer.Errors():
-			if err != nil {
-				log.Println(err.Err)
-			}
+		case msg := <-kafkaWriter.retryChan:
+			kafkaWriter.send(msg)
+		}
+	}
+}
+
+// allow wait until circuit allows a msg, the first msg after cooldown
+// is the half-open probe and others wait for its result
+func (kafkaWriter *KafkaWriter) allow() bool {
+	for !kafkaWriter.guard.Allow() {
+		delay := kafkaWriter.guard.cooldownLeft()
+		if delay < 100*time.Millisecond {
+			delay = 100 * time.Millisecond
+		}
+		select {
+		case <-time.After(delay):
+		case <-kafkaWriter.exitChan:
+			return false
+		}
+	}
+	return true
+}
+
+// send msg to producer through circuit, give up on stop
+func (kafkaWriter *KafkaWriter) send(msg *sarama.ProducerMessage) {
+	if !kafkaWriter.allow() {
+		kafkaWriter.metricstatus.WithLabelValues("dropped").Inc()
+		return
+	}
+	select {
+	case kafkaWriter.producer.Input() <- msg:
+	case <-kafkaWriter.exitChan:
+		kafkaWriter.metricstatus.WithLabelValues("dropped").Inc()
+	}
+}
+
+// results read producer results until producer is closed,
+// Successes and Errors are drained apart from Input so producer never blocks
+func (kafkaWriter *KafkaWriter) results() {
+	kafkaWriter.resultWg.Add(2)
+	go func() {
+		defer kafkaWriter.resultWg.Done()
+		for range kafkaWriter.producer.Successes() {
+			kafkaWriter.guard.Record(nil)
+		}
+	}()
+	go func() {
+		defer kafkaWriter.resultWg.Done()
+		for err := range kafkaWriter.producer.Errors() {
+			log.Println(err.Err)
+			kafkaWriter.guard.Record(err.Err)
+			kafkaWriter.retry(err.Msg)
 		}
+	}()
+}
+
+// retry resend msg after backoff
+func (kafkaWriter *KafkaWriter) retry(msg *sarama.ProducerMessage) {
+	attempt, _ := msg.Metadata.(int)
+	if attempt >= kafkaWriter.guard.MaxRetry {
+		kafkaWriter.metricstatus.WithLabelValues("dropped").Inc()
+		return
 	}
+	// producer message can not be reused
+	msg = &sarama.ProducerMessage{Topic: msg.Topic, Key: msg.Key, Value: msg.Value, Metadata: attempt + 1}
+	delay := kafkaWriter.guard.RetryBackoff(attempt)
+	go func() {
+		select {
+		case <-time.After(delay):
+		case <-kafkaWriter.exitChan:
+			return
+		}
+		select {
+		case kafkaWriter.retryChan <- msg:
+			kafkaWriter.metricstatus.WithLabelValues("retry").Inc()
+		case <-kafkaWriter.exitChan:
+		}
+	}()
 }
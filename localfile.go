@@ -2,17 +2,23 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // config
@@ -89,7 +95,7 @@ func (fs *FileExInfo) ReadLoop() {
 			fs.offsize, _ = fs.fd.Seek(0, io.SeekCurrent)
 			line, err := reader.ReadBytes('\n')
 			if err != nil && err != io.EOF {
-				fmt.Println(err)
+				log.Println(err)
 				if len(line) > 0 {
 					fs.fd.Seek(fs.offsize, io.SeekStart)
 				}
@@ -308,3 +314,353 @@ func (m *FileReader) Stop() {
 func (m *FileReader) GetMsgChan() chan *map[string][]byte {
 	return m.msgChan
 }
+
+// config
+// {
+// "Path":"/archive/{task}/{yyyy}/{mm}/{dd}/{tag}.log",
+// "Format":"json",
+// "RawField":"rawmsg",
+// "MaxSize":"512",
+// "RotateInterval":"3600",
+// "Compress":"true",
+// "SyncInterval":"1000",
+// "MaxOpenFiles":"64",
+// "Type":"file"
+// }
+// Path use {task}, {yyyy}, {mm}, {dd}, {hh} of event timestamp and {field}
+// Format json write ndjson, raw write RawField
+// MaxSize in MB, RotateInterval in seconds, SyncInterval in milliseconds
+// failed writes are retried by SinkGuard
+
+type outputFile struct {
+	path     string
+	fd       *os.File
+	writer   *bufio.Writer
+	size     int64
+	opened   time.Time
+	lastUsed time.Time
+}
+
+// FileWriter write msg to local files
+type FileWriter struct {
+	sync.Mutex
+	path           *FieldTemplate
+	Taskname       string
+	Format         string
+	RawField       string
+	MaxSize        int64
+	RotateInterval time.Duration
+	SyncInterval   time.Duration
+	Compress       bool
+	MaxOpenFiles   int
+	files          map[string]*outputFile
+	guard          *SinkGuard
+	wg             sinkWaitGroup
+	compressWg     sync.WaitGroup
+	exitChan       chan int
+	metricstatus   *prometheus.CounterVec
+}
+
+// NewFileWriter create FileWriter
+func NewFileWriter(config map[string]string) (*FileWriter, error) {
+	w := &FileWriter{
+		Taskname: config["Taskname"],
+		Format:   config["Format"],
+		RawField: config["RawField"],
+		Compress: config["Compress"] == "true",
+	}
+	if len(config["Path"]) == 0 {
+		return w, fmt.Errorf("no file path")
+	}
+	w.path = NewFieldTemplate(config["Path"])
+	if w.Format != "raw" {
+		w.Format = "json"
+	}
+	if len(w.RawField) == 0 {
+		w.RawField = "rawmsg"
+	}
+	maxSize, err := strconv.Atoi(config["MaxSize"])
+	if err != nil || maxSize < 1 {
+		maxSize = 512
+	}
+	w.MaxSize = int64(maxSize) * 1024 * 1024
+	interval, err := strconv.Atoi(config["RotateInterval"])
+	if err == nil && interval > 0 {
+		w.RotateInterval = time.Duration(interval) * time.Second
+	}
+	syncInterval, err := strconv.Atoi(config["SyncInterval"])
+	if err != nil || syncInterval < 100 {
+		syncInterval = 1000
+	}
+	w.SyncInterval = time.Duration(syncInterval) * time.Millisecond
+	w.MaxOpenFiles, err = strconv.Atoi(config["MaxOpenFiles"])
+	if err != nil || w.MaxOpenFiles < 1 {
+		w.MaxOpenFiles = 64
+	}
+	w.files = make(map[string]*outputFile)
+	w.exitChan = make(chan int)
+	w.metricstatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "lazy_output",
+			Name:      fmt.Sprintf("file_writer_%s", config["Taskname"]),
+			Help:      "file writer status.",
+		},
+		[]string{"method"},
+	)
+	// Register status
+	prometheus.Register(w.metricstatus)
+	w.guard = NewSinkGuard("file", config)
+	go w.syncLoop()
+	return w, nil
+}
+
+// Stop flush and close all files
+func (w *FileWriter) Stop() {
+	close(w.exitChan)
+	w.wg.Wait()
+	w.Lock()
+	for path, f := range w.files {
+		w.closeFile(f)
+		delete(w.files, path)
+	}
+	w.Unlock()
+	w.compressWg.Wait()
+	w.guard.Close()
+	log.Println("exit file writer")
+	prometheus.Unregister(w.metricstatus)
+}
+
+// Start run writer
+func (w *FileWriter) Start(dataChan chan *map[string]interface{}) {
+	if !w.wg.Add() {
+		return
+	}
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.exitChan:
+			return
+		case logmsg := <-dataChan:
+			var line []byte
+			if w.Format == "raw" {
+				value, ok := (*logmsg)[w.RawField]
+				if !ok {
+					w.metricstatus.WithLabelValues("missing_field").Inc()
+					break
+				}
+				line = []byte(strings.TrimRight(FormatValue(value), "\n"))
+			} else {
+				var err error
+				line, err = json.Marshal(logmsg)
+				if err != nil {
+					w.metricstatus.WithLabelValues("encode_failed").Inc()
+					break
+				}
+			}
+			path := w.filePath(logmsg)
+			// local write is not cancellable, AttemptTimeout does not apply
+			if err := w.guard.Do(func(ctx context.Context) error {
+				return w.write(path, line)
+			}); err != nil {
+				log.Println("file writer", err)
+				w.metricstatus.WithLabelValues("failed").Inc()
+				break
+			}
+			w.metricstatus.WithLabelValues("written").Inc()
+		}
+	}
+}
+
+func (w *FileWriter) filePath(msg *map[string]interface{}) string {
+	ts, ok := (*msg)["timestamp"].(time.Time)
+	if !ok {
+		ts = time.Now()
+	}
+	return w.path.RenderFunc(func(name string) (string, bool) {
+		switch name {
+		case "task":
+			return w.Taskname, true
+		case "yyyy":
+			return ts.Format("2006"), true
+		case "mm":
+			return ts.Format("01"), true
+		case "dd":
+			return ts.Format("02"), true
+		case "hh":
+			return ts.Format("15"), true
+		}
+		value, ok := LookupField(msg, name)
+		if !ok || len(value) == 0 || value == "." || value == ".." {
+			return "_", true
+		}
+		return strings.Replace(value, "/", "_", -1), true
+	})
+}
+
+func (w *FileWriter) write(path string, line []byte) error {
+	w.Lock()
+	defer w.Unlock()
+	f, ok := w.files[path]
+	if !ok {
+		var err error
+		f, err = w.openFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	if f.size+int64(len(line))+1 > w.MaxSize && f.size > 0 {
+		if err := w.rotate(f); err != nil {
+			return err
+		}
+	}
+	f.lastUsed = time.Now()
+	n, err := f.writer.Write(line)
+	f.size += int64(n)
+	if err == nil {
+		f.size++
+		err = f.writer.WriteByte('\n')
+	}
+	if err != nil {
+		// bufio error is sticky, reopen file on retry
+		w.closeFile(f)
+		delete(w.files, path)
+	}
+	return err
+}
+
+// openFile open file for append, least recently used file is closed
+// if there are too many open files
+func (w *FileWriter) openFile(path string) (*outputFile, error) {
+	if len(w.files) >= w.MaxOpenFiles {
+		var lru *outputFile
+		for _, f := range w.files {
+			if lru == nil || f.lastUsed.Before(lru.lastUsed) {
+				lru = f
+			}
+		}
+		w.closeFile(lru)
+		delete(w.files, lru.path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f := &outputFile{path: path, fd: fd, writer: bufio.NewWriterSize(fd, 64*1024), opened: time.Now()}
+	if stat, err := fd.Stat(); err == nil {
+		f.size = stat.Size()
+	}
+	w.files[path] = f
+	return f, nil
+}
+
+func (w *FileWriter) closeFile(f *outputFile) {
+	if err := f.writer.Flush(); err != nil {
+		log.Println("flush", f.path, err)
+	}
+	f.fd.Sync()
+	f.fd.Close()
+}
+
+// rotatedExists check rotated name against plain and gzipped files
+func rotatedExists(name string) bool {
+	for _, path := range []string{name, name + ".gz", name + ".gz.tmp"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// rotate rename current file with time suffix, gzip it if Compress
+func (w *FileWriter) rotate(f *outputFile) error {
+	w.closeFile(f)
+	stamp := time.Now().Format("20060102150405")
+	rotated := fmt.Sprintf("%s.%s", f.path, stamp)
+	// rotated file may be gzipped already or being gzipped
+	for i := 1; rotatedExists(rotated); i++ {
+		rotated = fmt.Sprintf("%s.%s.%d", f.path, stamp, i)
+	}
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	w.metricstatus.WithLabelValues("rotated").Inc()
+	if w.Compress {
+		w.compressWg.Add(1)
+		go w.compressFile(rotated)
+	}
+	fd, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		delete(w.files, f.path)
+		return err
+	}
+	f.fd = fd
+	f.writer.Reset(fd)
+	f.size = 0
+	f.opened = time.Now()
+	return nil
+}
+
+func (w *FileWriter) compressFile(name string) {
+	defer w.compressWg.Done()
+	src, err := os.Open(name)
+	if err != nil {
+		log.Println("compress", err)
+		return
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz.tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Println("compress", err)
+		return
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err != nil {
+		log.Println("compress", name, err)
+		os.Remove(name + ".gz.tmp")
+		return
+	}
+	if err = os.Rename(name+".gz.tmp", name+".gz"); err != nil {
+		log.Println("compress", name, err)
+		return
+	}
+	os.Remove(name)
+	w.metricstatus.WithLabelValues("compressed").Inc()
+}
+
+// syncLoop flush and fsync files, rotate files opened too long
+func (w *FileWriter) syncLoop() {
+	ticker := time.NewTicker(w.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.exitChan:
+			return
+		case <-ticker.C:
+			w.Lock()
+			for _, f := range w.files {
+				if w.RotateInterval > 0 && time.Since(f.opened) >= w.RotateInterval && f.size > 0 {
+					if err := w.rotate(f); err != nil {
+						log.Println("rotate", f.path, err)
+					}
+					continue
+				}
+				if err := f.writer.Flush(); err != nil {
+					log.Println("flush", f.path, err)
+				}
+				f.fd.Sync()
+			}
+			w.Unlock()
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// DecodeLogMsg decode input body by MessageFormat
+// protobuf: LogFormat, set msg, from, host, app, severity, timestamp
+// labels and fields are json encoded for LogParser
+// default: body as msg
+func DecodeLogMsg(format string, body []byte) (map[string][]byte, error) {
+	logmsg := make(map[string][]byte)
+	switch format {
+	case "protobuf":
+		var logFormat LogFormat
+		if err := proto.Unmarshal(body, &logFormat); err != nil {
+			return logmsg, err
+		}
+		logmsg["msg"] = []byte(logFormat.GetRawmsg())
+		logmsg["from"] = []byte(logFormat.GetFrom())
+		if logFormat.Timestamp != nil {
+			logmsg["timestamp"] = []byte(strconv.FormatInt(logFormat.GetTimestamp(), 10))
+		}
+		if logFormat.Host != nil {
+			logmsg["host"] = []byte(logFormat.GetHost())
+		}
+		if logFormat.App != nil {
+			logmsg["app"] = []byte(logFormat.GetApp())
+		}
+		if logFormat.Severity != nil {
+			logmsg["severity"] = []byte(strconv.Itoa(int(logFormat.GetSeverity())))
+		}
+		if len(logFormat.Labels) > 0 {
+			labels, err := json.Marshal(logFormat.Labels)
+			if err != nil {
+				return logmsg, err
+			}
+			logmsg["labels"] = labels
+		}
+		if len(logFormat.Fields) > 0 {
+			fields, err := json.Marshal(logFormat.Fields)
+			if err != nil {
+				return logmsg, err
+			}
+			logmsg["fields"] = fields
+		}
+	default:
+		logmsg["msg"] = body
+	}
+	return logmsg, nil
+}
@@ -18,8 +18,90 @@ type LogParser struct {
 	TokenFormat map[string]string `json:"TokenFormat,omitempty"`
 }
 
-// Handle convert log
+// Handle convert log, fields set by input (topic, from...) are kept
+// msg with pre-parsed fields from LogFormat is not parsed again
 func (l *LogParser) Handle(msg *map[string][]byte) (*map[string]interface{}, error) {
+	var data *map[string]interface{}
+	var err error
+	if fields, ok := (*msg)["fields"]; ok {
+		data, err = l.preParsed(fields, (*msg)["msg"])
+	} else {
+		data, err = l.parse(msg)
+	}
+	if err != nil {
+		return data, err
+	}
+	for k, v := range *msg {
+		switch k {
+		case "msg", "msgid", "fields":
+		case "timestamp":
+			// event time from input is unix time in milliseconds
+			if ms, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+				(*data)["timestamp"] = time.Unix(0, ms*int64(time.Millisecond))
+			}
+		case "labels":
+			var labels map[string]string
+			if err := json.Unmarshal(v, &labels); err == nil {
+				(*data)["labels"] = labels
+			}
+		case "severity":
+			if _, ok := (*data)[k]; ok {
+				break
+			}
+			if severity, err := strconv.Atoi(string(v)); err == nil {
+				(*data)[k] = severity
+			}
+		default:
+			if _, ok := (*data)[k]; !ok {
+				(*data)[k] = string(v)
+			}
+		}
+	}
+	return data, nil
+}
+
+// preParsed use fields sent by producer, TokenFormat is applied on them
+func (l *LogParser) preParsed(body []byte, rawmsg []byte) (*map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	var fields map[string]string
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return &data, err
+	}
+	for k, v := range fields {
+		format := l.TokenFormat[k]
+		switch format {
+		case "int":
+			t, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return &data, fmt.Errorf("data format err: %s %s", v, format)
+			}
+			data[k] = t
+		case "float":
+			t, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return &data, fmt.Errorf("data format err: %s %s", v, format)
+			}
+			data[k] = t
+		case "nginxtimestamp":
+			t, err := time.Parse("02/Jan/2006:15:04:05 -0700", v)
+			if err != nil {
+				return &data, fmt.Errorf("data format err: %s %s", v, format)
+			}
+			data[k] = t
+		default:
+			data[k] = v
+		}
+	}
+	if _, ok := data["rawmsg"]; !ok && len(rawmsg) > 0 {
+		data["rawmsg"] = string(rawmsg)
+	}
+	if _, ok := data["timestamp"]; !ok {
+		data["timestamp"] = time.Now()
+	}
+	return &data, nil
+}
+
+func (l *LogParser) parse(msg *map[string][]byte) (*map[string]interface{}, error) {
 	data := make(map[string]interface{})
 	var err error
 	switch l.LogType {
@@ -69,6 +151,44 @@ func (l *LogParser) Handle(msg *map[string][]byte) (*map[string]interface{}, err
 	return &data, err
 }
 
+// Schema return field types produced by parser
+// int, float, nginxtimestamp or string, timestamp field is time
+func (l *LogParser) Schema() map[string]string {
+	schema := make(map[string]string)
+	for _, token := range l.Tokens {
+		format, ok := l.TokenFormat[token]
+		if !ok {
+			continue
+		}
+		switch format {
+		case "strings":
+			for _, k := range strings.Split(token, " ") {
+				schema[k] = "string"
+			}
+		case "int", "float", "nginxtimestamp":
+			schema[token] = format
+		default:
+			schema[token] = "string"
+		}
+	}
+	// pre-parsed fields use TokenFormat without Tokens
+	for token, format := range l.TokenFormat {
+		if _, ok := schema[token]; ok || strings.Contains(token, " ") {
+			continue
+		}
+		switch format {
+		case "int", "float", "nginxtimestamp":
+			schema[token] = format
+		default:
+			schema[token] = "string"
+		}
+	}
+	if _, ok := schema["timestamp"]; !ok {
+		schema["timestamp"] = "time"
+	}
+	return schema
+}
+
 func (l *LogParser) wildFormat(msgTokens *[]string) (*map[string]interface{}, error) {
 	data := make(map[string]interface{})
 	if len(l.Tokens) != len(*msgTokens) {
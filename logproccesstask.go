@@ -15,6 +15,8 @@ import (
 // "LogParser":{},
 // "FilterOrder":"regexp,bayies",
 // "FilterSettings":{"regexp":{},"bayies":{}},
+// "StatsdAddr":"127.0.0.1:8125",
+// "Statsd":{"Timers":"request_time=RequestTime","Tags":"Host,Status"},
 // }
 
 // LogProccessTask log procceser
@@ -27,6 +29,10 @@ type LogProccessTask struct {
 	FilterOrder    []string                     `json:"FilterOrder,omitempty"`
 	FilterSettings map[string]map[string]string `json:"FilterSettings"`
 	Filters        map[string]Filter
+	// statsd side output
+	StatsdAddr    string            `json:"StatsdAddr,omitempty"`
+	StatsdSetting map[string]string `json:"Statsd,omitempty"`
+	Statsd        *StatsdWriter
 
 	Input  DataSource
 	Output DataSink
@@ -47,12 +53,57 @@ type DataSource interface {
 	GetMsgChan() chan *map[string][]byte
 }
 
+// Acknowledger DataSource which need to know the task result of msg
+// err is nil when msg is handed to the output, a parseError when msg can never be handled,
+// output failure after hand-off is not acked (at most once)
+type Acknowledger interface {
+	Ack(msg *map[string][]byte, err error)
+}
+
+// parseError msg is rejected by parser, redelivery will not help
+type parseError struct {
+	error
+}
+
 // DataSink msg dest
 type DataSink interface {
 	Stop()
 	Start(msgChan chan *map[string]interface{})
 }
 
+// sinkWaitGroup track running Start of a DataSink
+// Run may start the sink several times in its own goroutines, so Add is done by
+// Start under lock and refused once Stop began waiting, Stop never misses a flush
+type sinkWaitGroup struct {
+	sync.Mutex
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+// Add register a Start, return false if sink is stopped
+func (s *sinkWaitGroup) Add() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// Done Start returned
+func (s *sinkWaitGroup) Done() {
+	s.wg.Done()
+}
+
+// Wait refuse new Start and wait running ones
+func (s *sinkWaitGroup) Wait() {
+	s.Lock()
+	s.stopped = true
+	s.Unlock()
+	s.wg.Wait()
+}
+
 // Stop stop proccess task
 func (t *LogProccessTask) Stop() {
 	close(t.exitChan)
@@ -61,6 +112,9 @@ func (t *LogProccessTask) Stop() {
 		f.Cleanup()
 	}
 	t.Output.Stop()
+	if t.Statsd != nil {
+		t.Statsd.Stop()
+	}
 }
 
 // GetName get task name
@@ -161,7 +215,7 @@ func NewLogProcessTask(name string, config []byte) (*LogProccessTask, error) {
 	logProcessTask.OutputSetting["Taskname"] = taskname
 	switch logProcessTask.OutputSetting["Type"] {
 	case "elasticsearch":
-		logProcessTask.Output, err = NewElasitcSearchWriter(logProcessTask.OutputSetting)
+		logProcessTask.Output, err = NewElasitcSearchWriter(logProcessTask.OutputSetting, logProcessTask.Parser)
 		if err != nil {
 			return nil, err
 		}
@@ -175,13 +229,80 @@ func NewLogProcessTask(name string, config []byte) (*LogProccessTask, error) {
 		if err != nil {
 			return nil, err
 		}
+	case "mqtt":
+		logProcessTask.Output, err = NewMQTTWriter(logProcessTask.OutputSetting)
+		if err != nil {
+			return nil, err
+		}
+	case "influxdb":
+		logProcessTask.Output, err = NewInfluxDBWriter(logProcessTask.OutputSetting)
+		if err != nil {
+			return nil, err
+		}
+	case "loki":
+		logProcessTask.Output, err = NewLokiWriter(logProcessTask.OutputSetting)
+		if err != nil {
+			return nil, err
+		}
+	case "file":
+		logProcessTask.Output, err = NewFileWriter(logProcessTask.OutputSetting)
+		if err != nil {
+			return nil, err
+		}
+	case "http":
+		logProcessTask.Output, err = NewHTTPWriter(logProcessTask.OutputSetting)
+		if err != nil {
+			return nil, err
+		}
+	case "syslog":
+		logProcessTask.Output, err = NewSyslogWriter(logProcessTask.OutputSetting)
+		if err != nil {
+			return nil, err
+		}
+	case "stdout":
+		logProcessTask.Output, err = NewStdoutWriter(logProcessTask.OutputSetting)
+		if err != nil {
+			return nil, err
+		}
+	case "sql":
+		logProcessTask.Output, err = NewSQLWriter(logProcessTask.OutputSetting)
+		if err != nil {
+			return nil, err
+		}
+	case "parquet":
+		logProcessTask.Output, err = NewParquetWriter(logProcessTask.OutputSetting, logProcessTask.Parser)
+		if err != nil {
+			return nil, err
+		}
+	case "statsd":
+		logProcessTask.Output, err = NewStatsdWriter(logProcessTask.OutputSetting)
+		if err != nil {
+			return nil, err
+		}
+	case "clickhouse":
+		logProcessTask.Output, err = NewClickHouseWriter(logProcessTask.OutputSetting, logProcessTask.Parser)
+		if err != nil {
+			return nil, err
+		}
 	default:
 		return nil, fmt.Errorf("not supported sink")
 	}
+	if len(logProcessTask.StatsdAddr) > 0 {
+		if logProcessTask.StatsdSetting == nil {
+			logProcessTask.StatsdSetting = map[string]string{"Counters": "events"}
+		}
+		logProcessTask.StatsdSetting["Address"] = logProcessTask.StatsdAddr
+		logProcessTask.StatsdSetting["Taskname"] = taskname + "_side"
+		logProcessTask.Statsd, err = NewStatsdWriter(logProcessTask.StatsdSetting)
+		if err != nil {
+			logProcessTask.Output.Stop()
+			return nil, err
+		}
+	}
 	return logProcessTask, nil
 }
 
-// Run start task
+// Run start task, input msg is acked once it is sent to output
 func (t *LogProccessTask) Run() {
 	msgChan := t.Input.GetMsgChan()
 	parsedMsgChan := make(chan *map[string]interface{})
@@ -192,6 +313,7 @@ func (t *LogProccessTask) Run() {
 			rst, err := t.Parser.Handle(msg)
 			if err != nil {
 				log.Println(string((*msg)["msg"]), err)
+				t.ack(msg, parseError{err})
 				break
 			}
 			for _, name := range t.FilterOrder {
@@ -203,15 +325,31 @@ func (t *LogProccessTask) Run() {
 				}
 			}
 			if err != nil && err.Error() == "ignore" {
+				t.ack(msg, nil)
 				break
 			}
-			parsedMsgChan <- rst
+			if t.Statsd != nil {
+				t.Statsd.Handle(rst)
+			}
+			select {
+			case parsedMsgChan <- rst:
+				t.ack(msg, nil)
+			case <-t.exitChan:
+				t.ack(msg, fmt.Errorf("task stopped"))
+				return
+			}
 		case <-t.exitChan:
 			return
 		}
 	}
 }
 
+func (t *LogProccessTask) ack(msg *map[string][]byte, err error) {
+	if acker, ok := t.Input.(Acknowledger); ok {
+		acker.Ack(msg, err)
+	}
+}
+
 // IsGoodConfig check task config
 func (t *LogProccessTask) IsGoodConfig(config []byte) bool {
 	logProcessTask := &LogProccessTask{}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// config
+// {
+// "URL":"http://127.0.0.1:3100",
+// "Labels":"tag,Host,from",
+// "StaticLabels":"job=lazy,env=prod",
+// "LineField":"rawmsg",
+// "Encoding":"protobuf",
+// "TenantID":"",
+// "UserName":"",
+// "Password":"",
+// "BatchSize":"1000",
+// "FlushInterval":"1000",
+// "MaxRetry":"5",
+// "Timeout":"10000",
+// "MaxSampleAge":"168",
+// "Type":"loki"
+// }
+// LineField empty push event as json line
+// Encoding protobuf push snappy compressed PushRequest, json push json body
+// MaxSampleAge in hours, match loki reject_old_samples_max_age, streams whose last
+// pushed entry is older are forgotten
+
+var lokiLabelName = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+type lokiEntry struct {
+	ts   time.Time
+	line string
+}
+
+type lokiStream struct {
+	labels  string
+	kv      map[string]string
+	entries []lokiEntry
+}
+
+// LokiWriter loki push api writer
+type LokiWriter struct {
+	pushURL       string
+	Labels        []string
+	StaticLabels  map[string]string
+	LineField     string
+	Encoding      string
+	TenantID      string
+	UserName      string
+	Password      string
+	BatchSize     int
+	FlushInterval int
+	MaxSampleAge  time.Duration
+	guard         *SinkGuard
+	client        *http.Client
+	// serialize push and keep last pushed timestamp of streams
+	pushLock     sync.Mutex
+	lastPushed   map[string]time.Time
+	lastPrune    time.Time
+	wg           sinkWaitGroup
+	exitChan     chan int
+	metricstatus *prometheus.CounterVec
+}
+
+// NewLokiWriter create LokiWriter
+func NewLokiWriter(config map[string]string) (*LokiWriter, error) {
+	w := &LokiWriter{
+		LineField: config["LineField"],
+		Encoding:  config["Encoding"],
+		TenantID:  config["TenantID"],
+		UserName:  config["UserName"],
+		Password:  config["Password"],
+	}
+	w.pushURL = fmt.Sprintf("%s/loki/api/v1/push", strings.TrimRight(config["URL"], "/"))
+	w.Labels = splitKeys(config["Labels"])
+	w.StaticLabels = make(map[string]string)
+	for _, kv := range splitKeys(config["StaticLabels"]) {
+		items := strings.SplitN(kv, "=", 2)
+		if len(items) == 2 {
+			w.StaticLabels[lokiLabelName.ReplaceAllString(items[0], "_")] = items[1]
+		}
+	}
+	if len(w.Labels) == 0 && len(w.StaticLabels) == 0 {
+		return w, fmt.Errorf("no stream labels")
+	}
+	if w.Encoding != "json" {
+		w.Encoding = "protobuf"
+	}
+	var err error
+	w.BatchSize, err = strconv.Atoi(config["BatchSize"])
+	if err != nil || w.BatchSize < 1 {
+		w.BatchSize = 1000
+	}
+	w.FlushInterval, err = strconv.Atoi(config["FlushInterval"])
+	if err != nil || w.FlushInterval < 100 {
+		w.FlushInterval = 1000
+	}
+	maxAge, err := strconv.Atoi(config["MaxSampleAge"])
+	if err != nil || maxAge < 1 {
+		maxAge = 168
+	}
+	w.MaxSampleAge = time.Duration(maxAge) * time.Hour
+	timeout, err := strconv.Atoi(config["Timeout"])
+	if err != nil || timeout < 1000 {
+		timeout = 10000
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if strings.HasPrefix(w.pushURL, "https") {
+		transport.TLSClientConfig, err = NewTLSConfig(config)
+		if err != nil {
+			return w, err
+		}
+	}
+	w.client = &http.Client{Transport: transport, Timeout: time.Duration(timeout) * time.Millisecond}
+	w.lastPushed = make(map[string]time.Time)
+	w.exitChan = make(chan int)
+	w.metricstatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "lazy_output",
+			Name:      fmt.Sprintf("loki_writer_%s", config["Taskname"]),
+			Help:      "loki writer status.",
+		},
+		[]string{"method"},
+	)
+	// Register status
+	prometheus.Register(w.metricstatus)
+	w.guard = NewSinkGuard("loki", guardConfig(config, map[string]string{"MaxRetry": "5", "RetryBackoff": "1000"}))
+	return w, nil
+}
+
+// Stop close all
+func (w *LokiWriter) Stop() {
+	close(w.exitChan)
+	w.wg.Wait()
+	w.guard.Close()
+	log.Println("exit loki writer")
+	prometheus.Unregister(w.metricstatus)
+}
+
+// Start run writer
+func (w *LokiWriter) Start(dataChan chan *map[string]interface{}) {
+	if !w.wg.Add() {
+		return
+	}
+	defer w.wg.Done()
+	streams := make(map[string]*lokiStream)
+	count := 0
+	ticker := time.NewTicker(time.Duration(w.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.exitChan:
+			w.push(streams, count)
+			return
+		case <-ticker.C:
+			w.push(streams, count)
+			streams = make(map[string]*lokiStream)
+			count = 0
+		case logmsg := <-dataChan:
+			kv := w.streamLabels(logmsg)
+			labels := lokiLabelString(kv)
+			stream, ok := streams[labels]
+			if !ok {
+				stream = &lokiStream{labels: labels, kv: kv}
+				streams[labels] = stream
+			}
+			stream.entries = append(stream.entries, w.entry(logmsg))
+			count++
+			if count >= w.BatchSize {
+				w.push(streams, count)
+				streams = make(map[string]*lokiStream)
+				count = 0
+			}
+		}
+	}
+}
+
+func (w *LokiWriter) streamLabels(msg *map[string]interface{}) map[string]string {
+	kv := make(map[string]string)
+	for k, v := range w.StaticLabels {
+		kv[k] = v
+	}
+	for _, k := range w.Labels {
+		if value, ok := LookupField(msg, k); ok && len(value) > 0 {
+			kv[lokiLabelName.ReplaceAllString(k, "_")] = value
+		}
+	}
+	return kv
+}
+
+func lokiLabelString(kv map[string]string) string {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, strconv.Quote(kv[k])))
+	}
+	return fmt.Sprintf("{%s}", strings.Join(pairs, ", "))
+}
+
+func (w *LokiWriter) entry(msg *map[string]interface{}) lokiEntry {
+	e := lokiEntry{ts: time.Now()}
+	if ts, ok := (*msg)["timestamp"].(time.Time); ok {
+		e.ts = ts
+	}
+	if len(w.LineField) > 0 {
+		e.line, _ = LookupField(msg, w.LineField)
+		return e
+	}
+	line, err := json.Marshal(msg)
+	if err != nil {
+		w.metricstatus.WithLabelValues("encode_failed").Inc()
+	}
+	e.line = string(line)
+	return e
+}
+
+// push sort entries of stream, entries older than last pushed one use
+// the last timestamp to avoid out of order rejection
+func (w *LokiWriter) push(streams map[string]*lokiStream, count int) {
+	if count == 0 {
+		return
+	}
+	w.pushLock.Lock()
+	defer w.pushLock.Unlock()
+	for _, stream := range streams {
+		sort.SliceStable(stream.entries, func(i, j int) bool {
+			return stream.entries[i].ts.Before(stream.entries[j].ts)
+		})
+		last := w.lastPushed[stream.labels]
+		for i := range stream.entries {
+			if stream.entries[i].ts.Before(last) {
+				stream.entries[i].ts = last
+				w.metricstatus.WithLabelValues("out_of_order").Inc()
+			}
+		}
+	}
+	var body []byte
+	var err error
+	if w.Encoding == "json" {
+		body, err = lokiJSONBody(streams)
+	} else {
+		body, err = lokiProtobufBody(streams)
+	}
+	if err != nil {
+		log.Println("loki encode", err)
+		w.metricstatus.WithLabelValues("failed").Add(float64(count))
+		return
+	}
+	if err := w.guard.Do(func(ctx context.Context) error {
+		return w.send(ctx, body)
+	}); err == nil {
+		w.metricstatus.WithLabelValues("pushed").Add(float64(count))
+		for _, stream := range streams {
+			w.lastPushed[stream.labels] = stream.entries[len(stream.entries)-1].ts
+		}
+		w.prune()
+		return
+	}
+	w.metricstatus.WithLabelValues("failed").Add(float64(count))
+}
+
+// prune forget streams last pushed before MaxSampleAge, once a minute, must hold pushLock
+func (w *LokiWriter) prune() {
+	if time.Since(w.lastPrune) < time.Minute {
+		return
+	}
+	w.lastPrune = time.Now()
+	for labels, ts := range w.lastPushed {
+		if time.Since(ts) > w.MaxSampleAge {
+			delete(w.lastPushed, labels)
+		}
+	}
+}
+
+// send post body once, 429 is retried after Retry-After, other 4xx are permanent
+func (w *LokiWriter) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.pushURL, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	if w.Encoding == "json" {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
+	if len(w.TenantID) > 0 {
+		req.Header.Set("X-Scope-OrgID", w.TenantID)
+	}
+	if len(w.UserName) > 0 {
+		req.SetBasicAuth(w.UserName, w.Password)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		log.Println("loki push", err)
+		return err
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	res.Body.Close()
+	if res.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("loki push error: [%d] %s", res.StatusCode, msg)
+	log.Println(err)
+	if res.StatusCode == http.StatusTooManyRequests {
+		w.metricstatus.WithLabelValues("rate_limited").Inc()
+		if seconds, e := strconv.Atoi(res.Header.Get("Retry-After")); e == nil && seconds > 0 {
+			return RetryAfter(err, time.Duration(seconds)*time.Second)
+		}
+		return err
+	}
+	if res.StatusCode < 500 {
+		// out of order or too old entries are rejected permanently
+		if bytes.Contains(msg, []byte("out of order")) || bytes.Contains(msg, []byte("too far behind")) {
+			w.metricstatus.WithLabelValues("rejected_out_of_order").Inc()
+		}
+		return Permanent(err)
+	}
+	return err
+}
+
+func lokiJSONBody(streams map[string]*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	req := struct {
+		Streams []jsonStream `json:"streams"`
+	}{}
+	for _, stream := range streams {
+		s := jsonStream{Stream: stream.kv}
+		for _, e := range stream.entries {
+			s.Values = append(s.Values, [2]string{strconv.FormatInt(e.ts.UnixNano(), 10), e.line})
+		}
+		req.Streams = append(req.Streams, s)
+	}
+	return json.Marshal(req)
+}
+
+// lokiProtobufBody encode logproto.PushRequest and compress with snappy
+// PushRequest{1: repeated Stream}, Stream{1: labels, 2: repeated Entry}
+// Entry{1: Timestamp{1: seconds, 2: nanos}, 2: line}
+func lokiProtobufBody(streams map[string]*lokiStream) ([]byte, error) {
+	req := proto.NewBuffer(nil)
+	for _, stream := range streams {
+		s := proto.NewBuffer(nil)
+		s.EncodeVarint(1<<3 | proto.WireBytes)
+		s.EncodeStringBytes(stream.labels)
+		for _, e := range stream.entries {
+			ts := proto.NewBuffer(nil)
+			ts.EncodeVarint(1<<3 | proto.WireVarint)
+			ts.EncodeVarint(uint64(e.ts.Unix()))
+			ts.EncodeVarint(2<<3 | proto.WireVarint)
+			ts.EncodeVarint(uint64(e.ts.Nanosecond()))
+			entry := proto.NewBuffer(nil)
+			entry.EncodeVarint(1<<3 | proto.WireBytes)
+			entry.EncodeRawBytes(ts.Bytes())
+			entry.EncodeVarint(2<<3 | proto.WireBytes)
+			entry.EncodeStringBytes(e.line)
+			s.EncodeVarint(2<<3 | proto.WireBytes)
+			s.EncodeRawBytes(entry.Bytes())
+		}
+		if err := req.EncodeVarint(1<<3 | proto.WireBytes); err != nil {
+			return nil, err
+		}
+		if err := req.EncodeRawBytes(s.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	return snappy.Encode(nil, req.Bytes()), nil
+}
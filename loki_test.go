@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+)
+
+type protoField struct {
+	num    uint64
+	varint uint64
+	data   []byte
+}
+
+// decodeProtoFields split protobuf message into varint and bytes fields
+func decodeProtoFields(t *testing.T, data []byte) []protoField {
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := proto.DecodeVarint(data)
+		if n == 0 {
+			t.Fatalf("bad field key %v", data)
+		}
+		data = data[n:]
+		f := protoField{num: key >> 3}
+		switch key & 7 {
+		case proto.WireVarint:
+			f.varint, n = proto.DecodeVarint(data)
+			if n == 0 {
+				t.Fatalf("bad varint %v", data)
+			}
+		case proto.WireBytes:
+			size, m := proto.DecodeVarint(data)
+			if m == 0 || uint64(len(data)-m) < size {
+				t.Fatalf("bad length %v", data)
+			}
+			f.data = data[m : m+int(size)]
+			n = m + int(size)
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		data = data[n:]
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func TestLokiProtobufBody(t *testing.T) {
+	ts1 := time.Unix(1551675967, 123456789)
+	ts2 := time.Unix(1551675968, 0)
+	stream := &lokiStream{
+		labels:  `{job="lazy", tag="nginx"}`,
+		entries: []lokiEntry{{ts: ts1, line: "first line"}, {ts: ts2, line: "second"}},
+	}
+	body, err := lokiProtobufBody(map[string]*lokiStream{stream.labels: stream})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := decodeProtoFields(t, data)
+	if len(req) != 1 || req[0].num != 1 {
+		t.Fatalf("PushRequest fields = %v, want one stream", req)
+	}
+	s := decodeProtoFields(t, req[0].data)
+	if len(s) != 3 || s[0].num != 1 || string(s[0].data) != stream.labels {
+		t.Fatalf("Stream fields = %v, want labels and 2 entries", s)
+	}
+	for i, e := range stream.entries {
+		entry := decodeProtoFields(t, s[i+1].data)
+		if s[i+1].num != 2 || len(entry) != 2 || entry[0].num != 1 || entry[1].num != 2 {
+			t.Fatalf("Entry %d fields = %v", i, entry)
+		}
+		if string(entry[1].data) != e.line {
+			t.Errorf("Entry %d line = %q, want %q", i, entry[1].data, e.line)
+		}
+		got := decodeProtoFields(t, entry[0].data)
+		want := []protoField{{num: 1, varint: uint64(e.ts.Unix())}, {num: 2, varint: uint64(e.ts.Nanosecond())}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Entry %d timestamp = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestLokiLabelString(t *testing.T) {
+	tests := []struct {
+		kv   map[string]string
+		want string
+	}{
+		{map[string]string{"job": "lazy"}, `{job="lazy"}`},
+		{map[string]string{"tag": "nginx", "job": "lazy"}, `{job="lazy", tag="nginx"}`},
+		{map[string]string{"path": `a"b\c`}, `{path="a\"b\\c"}`},
+	}
+	for _, tt := range tests {
+		if got := lokiLabelString(tt.kv); got != tt.want {
+			t.Errorf("lokiLabelString(%v) = %s, want %s", tt.kv, got, tt.want)
+		}
+	}
+}
@@ -1,3 +1,6 @@
+//go:build lstm
+// +build lstm
+
 package main
 
 import (
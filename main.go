@@ -54,14 +54,14 @@ func main() {
 				}
 				w, err := NewLogProcessTask(k, []byte(v))
 				if err != nil {
-					fmt.Println(err, v)
+					log.Println(err, v)
 					continue
 				}
 				for i := 0; i < taskParallel; i++ {
 					go w.Run()
 				}
 				taskPool.Join(w)
-				fmt.Println("task", k, "is started")
+				log.Println("task", k, "is started")
 			}
 		case <-termchan:
 			taskPool.Stop()
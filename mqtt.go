@@ -1,7 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,42 +17,133 @@ import (
 // {
 // "BrokerURL":"tcp://localhost:1883",
 // "Name":"mqttreader",
-// "Topic":"#",
+// "Topics":"site/+site/device/+id:1,alerts/#:2",
+// "QoS":"0",
+// "MessageFormat":"protobuf",
 // "UserName":"xxx",
 // "Password":"xxxx",
 // "CleanSession":"true",
+// "KeepAlive":"30",
+// "TLSCAFile":"/etc/mqtt/ca.pem",
+// "TLSCertFile":"/etc/mqtt/client.pem",
+// "TLSKeyFile":"/etc/mqtt/client.key",
+// "TLSInsecureSkipVerify":"false",
 // "Type":"mqtt"
 // }
+// Topics is a list of topic:qos, the +name and #name segments are
+// subscribed as + and # wildcards, the matched value is set to field name
+
+// MQTTSubscription topic filter with field template
+type MQTTSubscription struct {
+	Filter   string
+	QoS      byte
+	segments []string
+	fields   []string
+}
+
+// NewMQTTSubscription create MQTTSubscription from topic template
+func NewMQTTSubscription(template string, qos byte) *MQTTSubscription {
+	s := &MQTTSubscription{QoS: qos}
+	for _, segment := range strings.Split(template, "/") {
+		field := ""
+		if len(segment) > 1 && (segment[0] == '+' || segment[0] == '#') {
+			field = segment[1:]
+			segment = segment[:1]
+		}
+		s.segments = append(s.segments, segment)
+		s.fields = append(s.fields, field)
+	}
+	s.Filter = strings.Join(s.segments, "/")
+	return s
+}
+
+// Match check topic and return template fields
+func (s *MQTTSubscription) Match(topic string) (map[string]string, bool) {
+	fields := make(map[string]string)
+	levels := strings.Split(topic, "/")
+	for i, segment := range s.segments {
+		if segment == "#" {
+			if len(s.fields[i]) > 0 {
+				fields[s.fields[i]] = strings.Join(levels[i:], "/")
+			}
+			return fields, true
+		}
+		if i >= len(levels) {
+			return fields, false
+		}
+		if segment == "+" {
+			if len(s.fields[i]) > 0 {
+				fields[s.fields[i]] = levels[i]
+			}
+			continue
+		}
+		if segment != levels[i] {
+			return fields, false
+		}
+	}
+	return fields, len(levels) == len(s.segments)
+}
 
 // MQTTReader mqtt reader
 type MQTTReader struct {
-	client       mqtt.Client
-	Topic        string
-	msgChan      chan *map[string][]byte
-	metricstatus *prometheus.CounterVec
+	client        mqtt.Client
+	Topic         string
+	subscriptions []*MQTTSubscription
+	msgFormat     string
+	msgChan       chan *map[string][]byte
+	metricstatus  *prometheus.CounterVec
 }
 
 // NewMQTTReader create MQTTReader
 func NewMQTTReader(config map[string]string) (*MQTTReader, error) {
 	m := &MQTTReader{}
 	m.msgChan = make(chan *map[string][]byte)
-	m.Topic = config["Topic"]
+	m.msgFormat = config["MessageFormat"]
+	m.Topic = config["Topics"]
+	if len(m.Topic) == 0 {
+		m.Topic = config["Topic"]
+	}
+	qos, err := strconv.Atoi(config["QoS"])
+	if err != nil || qos < 0 || qos > 2 {
+		qos = 0
+	}
+	for _, item := range strings.Split(m.Topic, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		topicQoS := qos
+		if i := strings.LastIndex(item, ":"); i > 0 {
+			topicQoS, err = strconv.Atoi(item[i+1:])
+			if err != nil || topicQoS < 0 || topicQoS > 2 {
+				return m, fmt.Errorf("bad qos in topic %s", item)
+			}
+			item = item[:i]
+		}
+		m.subscriptions = append(m.subscriptions, NewMQTTSubscription(item, byte(topicQoS)))
+	}
+	if len(m.subscriptions) == 0 {
+		return m, fmt.Errorf("no topic to subscribe")
+	}
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(config["BrokerURL"])
 	opts.SetClientID(config["Name"])
 	opts.SetUsername(config["UserName"])
 	opts.SetPassword(config["Password"])
-	if config["CleanSession"] == "true" {
-		opts.SetCleanSession(true)
+	opts.SetCleanSession(config["CleanSession"] != "false")
+	if keepalive, err := strconv.Atoi(config["KeepAlive"]); err == nil && keepalive > 0 {
+		opts.SetKeepAlive(time.Duration(keepalive) * time.Second)
+	}
+	if len(config["TLSCAFile"]) > 0 || len(config["TLSCertFile"]) > 0 || config["TLSInsecureSkipVerify"] == "true" {
+		tlsConfig, err := NewTLSConfig(config)
+		if err != nil {
+			return m, err
+		}
+		opts.SetTLSConfig(tlsConfig)
 	}
 	opts.SetDefaultPublishHandler(m.HandleDate)
 	opts.SetOnConnectHandler(m.onConnect)
 	opts.SetConnectionLostHandler(m.onLost)
-	m.client = mqtt.NewClient(opts)
-	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
-		return m, token.Error()
-	}
-	fmt.Println(config["Name"], "mqtt reader is started")
 	m.metricstatus = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Subsystem: "lazy_intput",
@@ -57,37 +154,324 @@ func NewMQTTReader(config map[string]string) (*MQTTReader, error) {
 	)
 	// Register status
 	prometheus.Register(m.metricstatus)
+	m.client = mqtt.NewClient(opts)
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+		prometheus.Unregister(m.metricstatus)
+		return m, token.Error()
+	}
+	log.Println(config["Name"], "mqtt reader is started")
 	return m, nil
 }
 
 // HandleDate handle msg
 func (m *MQTTReader) HandleDate(client mqtt.Client, msg mqtt.Message) {
-	payload := msg.Payload()
-	if string(payload) == "Connected" {
+	topic := msg.Topic()
+	logmsg, err := DecodeLogMsg(m.msgFormat, msg.Payload())
+	if err != nil {
+		log.Println("decode", m.msgFormat, err, topic)
+		m.metricstatus.WithLabelValues("decode_failed").Inc()
 		return
 	}
-	topic := msg.Topic()
-	logmsg := make(map[string][]byte)
-	logmsg["msg"] = []byte(fmt.Sprintf("%s %s", topic, payload))
+	for _, s := range m.subscriptions {
+		if fields, ok := s.Match(topic); ok {
+			for k, v := range fields {
+				logmsg[k] = []byte(v)
+			}
+			break
+		}
+	}
+	logmsg["topic"] = []byte(topic)
 	m.msgChan <- &logmsg
 	m.metricstatus.WithLabelValues("message").Inc()
 }
 func (m *MQTTReader) onConnect(client mqtt.Client) {
-	if token := m.client.Subscribe(m.Topic, byte(0), nil); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
+	filters := make(map[string]byte)
+	for _, s := range m.subscriptions {
+		filters[s.Filter] = s.QoS
+	}
+	if token := m.client.SubscribeMultiple(filters, nil); token.Wait() && token.Error() != nil {
+		log.Println(token.Error())
 	}
 }
 
 // Stop close all
 func (m *MQTTReader) Stop() {
-	m.client.Disconnect(1)
+	m.client.Disconnect(250)
 	prometheus.Unregister(m.metricstatus)
 }
 func (m *MQTTReader) onLost(client mqtt.Client, err error) {
-	fmt.Println(err, m.Topic)
+	log.Println(err, m.Topic)
 }
 
 // GetMsgChan return channel
 func (m *MQTTReader) GetMsgChan() chan *map[string][]byte {
 	return m.msgChan
 }
+
+// config
+// {
+// "BrokerURL":"tcp://localhost:1883",
+// "Name":"mqttwriter",
+// "Topic":"devices/{host}/alerts",
+// "DefaultTopic":"devices/unknown/alerts",
+// "QoS":"1",
+// "Retain":"false",
+// "Encoding":"json",
+// "RawField":"rawmsg",
+// "MatchField":"tag_content_RegexpCheck",
+// "MatchValue":"critical",
+// "BufferSize":"10000",
+// "PublishTimeout":"5000",
+// "UserName":"xxx",
+// "Password":"xxxx",
+// "KeepAlive":"30",
+// "Type":"mqtt"
+// }
+// Encoding json publish whole event, raw publish RawField only
+// only events with MatchField == MatchValue are published if MatchField is set
+// '/', '+' and '#' in topic field values are replaced by '_', events missing a
+// topic field are published to DefaultTopic, or dropped if it is not set
+// msg failed to publish or sent while disconnected are buffered (BufferSize) and
+// sent in order before newer msg, buffer is also flushed every second
+
+type mqttOutMsg struct {
+	topic   string
+	payload []byte
+}
+
+// MQTTWriter mqtt writer
+type MQTTWriter struct {
+	sync.Mutex
+	client         mqtt.Client
+	topic          *FieldTemplate
+	DefaultTopic   string
+	QoS            byte
+	Retain         bool
+	Encoding       string
+	RawField       string
+	MatchField     string
+	MatchValue     string
+	BufferSize     int
+	PublishTimeout time.Duration
+	buffer         []mqttOutMsg
+	flushLock      sync.Mutex
+	exitChan       chan int
+	metricstatus   *prometheus.CounterVec
+}
+
+// NewMQTTWriter create MQTTWriter
+func NewMQTTWriter(config map[string]string) (*MQTTWriter, error) {
+	m := &MQTTWriter{}
+	m.exitChan = make(chan int)
+	if len(config["Topic"]) == 0 {
+		return m, fmt.Errorf("no topic to publish")
+	}
+	m.topic = NewFieldTemplate(config["Topic"])
+	m.DefaultTopic = config["DefaultTopic"]
+	qos, err := strconv.Atoi(config["QoS"])
+	if err != nil || qos < 0 || qos > 2 {
+		qos = 0
+	}
+	m.QoS = byte(qos)
+	m.Retain = config["Retain"] == "true"
+	m.Encoding = config["Encoding"]
+	if m.Encoding != "raw" {
+		m.Encoding = "json"
+	}
+	m.RawField = config["RawField"]
+	if len(m.RawField) == 0 {
+		m.RawField = "rawmsg"
+	}
+	m.MatchField = config["MatchField"]
+	m.MatchValue = config["MatchValue"]
+	m.BufferSize, err = strconv.Atoi(config["BufferSize"])
+	if err != nil || m.BufferSize < 1 {
+		m.BufferSize = 10000
+	}
+	timeout, err := strconv.Atoi(config["PublishTimeout"])
+	if err != nil || timeout < 100 {
+		timeout = 5000
+	}
+	m.PublishTimeout = time.Duration(timeout) * time.Millisecond
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(config["BrokerURL"])
+	opts.SetClientID(config["Name"])
+	opts.SetUsername(config["UserName"])
+	opts.SetPassword(config["Password"])
+	opts.SetAutoReconnect(true)
+	if keepalive, err := strconv.Atoi(config["KeepAlive"]); err == nil && keepalive > 0 {
+		opts.SetKeepAlive(time.Duration(keepalive) * time.Second)
+	}
+	if len(config["TLSCAFile"]) > 0 || len(config["TLSCertFile"]) > 0 || config["TLSInsecureSkipVerify"] == "true" {
+		tlsConfig, err := NewTLSConfig(config)
+		if err != nil {
+			return m, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.SetOnConnectHandler(m.onConnect)
+	opts.SetConnectionLostHandler(m.onLost)
+	m.metricstatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "lazy_output",
+			Name:      fmt.Sprintf("mqtt_producer_%s", config["Taskname"]),
+			Help:      "mqtt producer status.",
+		},
+		[]string{"method"},
+	)
+	m.client = mqtt.NewClient(opts)
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+		return m, token.Error()
+	}
+	// Register status
+	prometheus.Register(m.metricstatus)
+	return m, nil
+}
+
+// Stop close all
+func (m *MQTTWriter) Stop() {
+	close(m.exitChan)
+	m.client.Disconnect(250)
+	log.Println("exit mqtt producer")
+	prometheus.Unregister(m.metricstatus)
+}
+
+// Start run writer
+func (m *MQTTWriter) Start(dataChan chan *map[string]interface{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.exitChan:
+			return
+		case <-ticker.C:
+			m.flushBuffer()
+		case logmsg := <-dataChan:
+			if len(m.MatchField) > 0 {
+				if value, _ := LookupField(logmsg, m.MatchField); value != m.MatchValue {
+					break
+				}
+			}
+			topic, ok := m.renderTopic(logmsg)
+			if !ok {
+				m.metricstatus.WithLabelValues("missing_topic_field").Inc()
+				break
+			}
+			out := mqttOutMsg{topic: topic}
+			if m.Encoding == "raw" {
+				value, ok := (*logmsg)[m.RawField]
+				if !ok {
+					m.metricstatus.WithLabelValues("missing_field").Inc()
+					break
+				}
+				out.payload = []byte(FormatValue(value))
+			} else {
+				payload, err := json.Marshal(logmsg)
+				if err != nil {
+					m.metricstatus.WithLabelValues("encode_failed").Inc()
+					break
+				}
+				out.payload = payload
+			}
+			m.publish(out)
+		}
+	}
+}
+
+// renderTopic render topic template with escaped field values
+// DefaultTopic is used if a field is missing, false if there is none
+func (m *MQTTWriter) renderTopic(logmsg *map[string]interface{}) (string, bool) {
+	missing := false
+	topic := m.topic.RenderFunc(func(name string) (string, bool) {
+		value, ok := LookupField(logmsg, name)
+		if !ok || len(value) == 0 {
+			missing = true
+			return "", false
+		}
+		return strings.Map(func(r rune) rune {
+			switch r {
+			case '/', '+', '#', 0:
+				return '_'
+			}
+			return r
+		}, value), true
+	})
+	if missing {
+		return m.DefaultTopic, len(m.DefaultTopic) > 0
+	}
+	return topic, true
+}
+
+// publish send msg after buffered msg, msg is buffered if they can not be sent
+func (m *MQTTWriter) publish(out mqttOutMsg) {
+	if m.pending() {
+		m.flushBuffer()
+	}
+	if m.pending() || !m.client.IsConnectionOpen() || !m.send(out) {
+		m.bufferMsg(out)
+	}
+}
+
+// send publish msg once
+func (m *MQTTWriter) send(out mqttOutMsg) bool {
+	token := m.client.Publish(out.topic, m.QoS, m.Retain, out.payload)
+	if !token.WaitTimeout(m.PublishTimeout) || token.Error() != nil {
+		m.metricstatus.WithLabelValues("failed").Inc()
+		return false
+	}
+	m.metricstatus.WithLabelValues("publish").Inc()
+	return true
+}
+
+func (m *MQTTWriter) pending() bool {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.buffer) > 0
+}
+
+// bufferMsg keep msg in memory until sent, oldest msg dropped if full
+func (m *MQTTWriter) bufferMsg(out mqttOutMsg) {
+	m.Lock()
+	if len(m.buffer) >= m.BufferSize {
+		m.buffer = m.buffer[1:]
+		m.metricstatus.WithLabelValues("dropped").Inc()
+	}
+	m.buffer = append(m.buffer, out)
+	m.Unlock()
+	m.metricstatus.WithLabelValues("buffered").Inc()
+}
+
+// flushBuffer send buffered msg in order while connected, one flush at a time
+func (m *MQTTWriter) flushBuffer() {
+	m.flushLock.Lock()
+	defer m.flushLock.Unlock()
+	for m.client.IsConnectionOpen() {
+		m.Lock()
+		if len(m.buffer) == 0 {
+			m.Unlock()
+			return
+		}
+		out := m.buffer[0]
+		m.buffer = m.buffer[1:]
+		m.Unlock()
+		if !m.send(out) {
+			// keep failed msg in front of newer ones
+			m.Lock()
+			if len(m.buffer) < m.BufferSize {
+				m.buffer = append([]mqttOutMsg{out}, m.buffer...)
+			} else {
+				m.metricstatus.WithLabelValues("dropped").Inc()
+			}
+			m.Unlock()
+			return
+		}
+	}
+}
+
+func (m *MQTTWriter) onConnect(client mqtt.Client) {
+	go m.flushBuffer()
+}
+
+func (m *MQTTWriter) onLost(client mqtt.Client, err error) {
+	log.Println("mqtt producer connection lost", err, m.topic.Template)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMQTTSubscriptionMatch(t *testing.T) {
+	tests := []struct {
+		template string
+		filter   string
+		topic    string
+		ok       bool
+		fields   map[string]string
+	}{
+		{"site/device", "site/device", "site/device", true, map[string]string{}},
+		{"site/device", "site/device", "site/other", false, nil},
+		{"site/+/status", "site/+/status", "site/a/status", true, map[string]string{}},
+		{"site/+site/device/+id", "site/+/device/+", "site/bj/device/42", true, map[string]string{"site": "bj", "id": "42"}},
+		{"site/+site/device/+id", "site/+/device/+", "site/bj/device", false, nil},
+		{"site/+site/device/+id", "site/+/device/+", "site/bj/device/42/extra", false, nil},
+		{"site/#", "site/#", "site/a/b/c", true, map[string]string{}},
+		{"site/#rest", "site/#", "site/a/b/c", true, map[string]string{"rest": "a/b/c"}},
+		{"site/+site/#rest", "site/+/#", "site/bj/x/y", true, map[string]string{"site": "bj", "rest": "x/y"}},
+		{"#all", "#", "a/b", true, map[string]string{"all": "a/b"}},
+		{"+", "+", "a/b", false, nil},
+	}
+	for _, tt := range tests {
+		s := NewMQTTSubscription(tt.template, 1)
+		if s.Filter != tt.filter {
+			t.Errorf("%q Filter = %q, want %q", tt.template, s.Filter, tt.filter)
+		}
+		fields, ok := s.Match(tt.topic)
+		if ok != tt.ok || ok && !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%q Match(%q) = %v, %v, want %v, %v", tt.template, tt.topic, fields, ok, tt.fields, tt.ok)
+		}
+	}
+}
+
+func TestMQTTWriterRenderTopic(t *testing.T) {
+	tests := []struct {
+		template     string
+		defaultTopic string
+		msg          map[string]interface{}
+		topic        string
+		ok           bool
+	}{
+		{"devices/{host}/alerts", "", map[string]interface{}{"host": "web1"}, "devices/web1/alerts", true},
+		{"devices/{host}/alerts", "", map[string]interface{}{"host": "a/b+c#d"}, "devices/a_b_c_d/alerts", true},
+		{"devices/{host}/alerts", "", map[string]interface{}{}, "", false},
+		{"devices/{host}/alerts", "", map[string]interface{}{"host": ""}, "", false},
+		{"devices/{host}/alerts", "devices/unknown/alerts", map[string]interface{}{}, "devices/unknown/alerts", true},
+		{"alerts", "", map[string]interface{}{}, "alerts", true},
+	}
+	for _, tt := range tests {
+		m := &MQTTWriter{topic: NewFieldTemplate(tt.template), DefaultTopic: tt.defaultTopic}
+		topic, ok := m.renderTopic(&tt.msg)
+		if topic != tt.topic || ok != tt.ok {
+			t.Errorf("%q %v renderTopic() = %q, %v, want %q, %v", tt.template, tt.msg, topic, ok, tt.topic, tt.ok)
+		}
+	}
+}
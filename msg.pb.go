@@ -1,21 +1,13 @@
-// Code generated by protoc-gen-go.
+// Code generated by protoc-gen-go. DO NOT EDIT.
 // source: msg.proto
-// DO NOT EDIT!
 
-/*
-Package main is a generated protocol buffer package.
-
-It is generated from these files:
-	msg.proto
-
-It has these top-level messages:
-	LogFormat
-*/
 package main
 
-import proto "github.com/golang/protobuf/proto"
-import fmt "fmt"
-import math "math"
+import (
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	math "math"
+)
 
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
@@ -24,18 +16,48 @@ var _ = math.Inf
 
 // This is a compile-time assertion to ensure that this generated file
 // is compatible with the proto package it is being compiled against.
-const _ = proto.ProtoPackageIsVersion1
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
 type LogFormat struct {
-	From             *string `protobuf:"bytes,1,opt,name=from" json:"from,omitempty"`
-	Rawmsg           *string `protobuf:"bytes,2,opt,name=rawmsg" json:"rawmsg,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	From                 *string           `protobuf:"bytes,1,opt,name=from" json:"from,omitempty"`
+	Rawmsg               *string           `protobuf:"bytes,2,opt,name=rawmsg" json:"rawmsg,omitempty"`
+	Timestamp            *int64            `protobuf:"varint,3,opt,name=timestamp" json:"timestamp,omitempty"`
+	Host                 *string           `protobuf:"bytes,4,opt,name=host" json:"host,omitempty"`
+	App                  *string           `protobuf:"bytes,5,opt,name=app" json:"app,omitempty"`
+	Severity             *int32            `protobuf:"varint,6,opt,name=severity" json:"severity,omitempty"`
+	Labels               map[string]string `protobuf:"bytes,7,rep,name=labels" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Fields               map[string]string `protobuf:"bytes,8,rep,name=fields" json:"fields,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *LogFormat) Reset()         { *m = LogFormat{} }
+func (m *LogFormat) String() string { return proto.CompactTextString(m) }
+func (*LogFormat) ProtoMessage()    {}
+func (*LogFormat) Descriptor() ([]byte, []int) {
+	return fileDescriptor_c06e4cca6c2cc899, []int{0}
+}
+
+func (m *LogFormat) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_LogFormat.Unmarshal(m, b)
+}
+func (m *LogFormat) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_LogFormat.Marshal(b, m, deterministic)
+}
+func (m *LogFormat) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LogFormat.Merge(m, src)
+}
+func (m *LogFormat) XXX_Size() int {
+	return xxx_messageInfo_LogFormat.Size(m)
+}
+func (m *LogFormat) XXX_DiscardUnknown() {
+	xxx_messageInfo_LogFormat.DiscardUnknown(m)
 }
 
-func (m *LogFormat) Reset()                    { *m = LogFormat{} }
-func (m *LogFormat) String() string            { return proto.CompactTextString(m) }
-func (*LogFormat) ProtoMessage()               {}
-func (*LogFormat) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+var xxx_messageInfo_LogFormat proto.InternalMessageInfo
 
 func (m *LogFormat) GetFrom() string {
 	if m != nil && m.From != nil {
@@ -51,16 +73,71 @@ func (m *LogFormat) GetRawmsg() string {
 	return ""
 }
 
+func (m *LogFormat) GetTimestamp() int64 {
+	if m != nil && m.Timestamp != nil {
+		return *m.Timestamp
+	}
+	return 0
+}
+
+func (m *LogFormat) GetHost() string {
+	if m != nil && m.Host != nil {
+		return *m.Host
+	}
+	return ""
+}
+
+func (m *LogFormat) GetApp() string {
+	if m != nil && m.App != nil {
+		return *m.App
+	}
+	return ""
+}
+
+func (m *LogFormat) GetSeverity() int32 {
+	if m != nil && m.Severity != nil {
+		return *m.Severity
+	}
+	return 0
+}
+
+func (m *LogFormat) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *LogFormat) GetFields() map[string]string {
+	if m != nil {
+		return m.Fields
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*LogFormat)(nil), "main.LogFormat")
+	proto.RegisterMapType((map[string]string)(nil), "main.LogFormat.FieldsEntry")
+	proto.RegisterMapType((map[string]string)(nil), "main.LogFormat.LabelsEntry")
 }
 
-var fileDescriptor0 = []byte{
-	// 81 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0xe2, 0xcc, 0x2d, 0x4e, 0xd7,
-	0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0xc9, 0x4d, 0xcc, 0xcc, 0x53, 0xd2, 0xe4, 0xe2, 0xf4,
-	0xc9, 0x4f, 0x77, 0xcb, 0x2f, 0xca, 0x4d, 0x2c, 0x11, 0xe2, 0xe1, 0x62, 0x49, 0x2b, 0xca, 0xcf,
-	0x95, 0x60, 0x54, 0x60, 0xd4, 0xe0, 0x14, 0xe2, 0xe3, 0x62, 0x2b, 0x4a, 0x2c, 0x07, 0x6a, 0x90,
-	0x60, 0x02, 0xf1, 0x01, 0x01, 0x00, 0x00, 0xff, 0xff, 0x41, 0x5b, 0xc1, 0x83, 0x3c, 0x00, 0x00,
-	0x00,
+func init() { proto.RegisterFile("msg.proto", fileDescriptor_c06e4cca6c2cc899) }
+
+var fileDescriptor_c06e4cca6c2cc899 = []byte{
+	// 238 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x90, 0x3f, 0x4f, 0xc3, 0x30,
+	0x10, 0xc5, 0xe5, 0xfc, 0xa3, 0xb9, 0x2e, 0xe8, 0x84, 0xd0, 0xa9, 0x30, 0x44, 0x4c, 0x99, 0x32,
+	0xc0, 0x02, 0xec, 0x74, 0xea, 0x94, 0x6f, 0x60, 0x84, 0x1b, 0x22, 0xe2, 0xda, 0xb2, 0x4d, 0x51,
+	0x3e, 0x39, 0x2b, 0x3a, 0xc7, 0x2a, 0x1d, 0x58, 0xd8, 0xde, 0xbd, 0xbb, 0xdf, 0xd3, 0xd3, 0x41,
+	0xad, 0xfd, 0xd0, 0x59, 0x67, 0x82, 0xc1, 0x42, 0xcb, 0xf1, 0x70, 0xf7, 0x9d, 0x41, 0xbd, 0x33,
+	0xc3, 0xd6, 0x38, 0x2d, 0x03, 0x22, 0x14, 0x7b, 0x67, 0x34, 0x89, 0x46, 0xb4, 0x75, 0x1f, 0x35,
+	0x5e, 0x43, 0xe5, 0xe4, 0x97, 0xf6, 0x03, 0x65, 0xd1, 0x4d, 0x13, 0xde, 0x42, 0x1d, 0x46, 0xad,
+	0x7c, 0x90, 0xda, 0x52, 0xde, 0x88, 0x36, 0xef, 0x7f, 0x0d, 0x4e, 0x7a, 0x37, 0x3e, 0x50, 0xb1,
+	0x24, 0xb1, 0xc6, 0x4b, 0xc8, 0xa5, 0xb5, 0x54, 0x46, 0x8b, 0x25, 0x6e, 0x60, 0xe5, 0xd5, 0x51,
+	0xb9, 0x31, 0xcc, 0x54, 0x35, 0xa2, 0x2d, 0xfb, 0xd3, 0x8c, 0x0f, 0x50, 0x4d, 0xf2, 0x55, 0x4d,
+	0x9e, 0x2e, 0x9a, 0xbc, 0x5d, 0xdf, 0xdf, 0x74, 0x5c, 0xb8, 0x3b, 0x95, 0xed, 0x76, 0x71, 0xfb,
+	0x72, 0x08, 0x6e, 0xee, 0xd3, 0x29, 0x43, 0xfb, 0x51, 0x4d, 0x6f, 0x9e, 0x56, 0x7f, 0x43, 0xdb,
+	0xb8, 0x4d, 0xd0, 0x72, 0xba, 0x79, 0x82, 0xf5, 0x59, 0x16, 0xd7, 0xfc, 0x50, 0x73, 0xfa, 0x01,
+	0x4b, 0xbc, 0x82, 0xf2, 0x28, 0xa7, 0x4f, 0x95, 0x3e, 0xb0, 0x0c, 0xcf, 0xd9, 0xa3, 0x60, 0xf4,
+	0x2c, 0xf1, 0x3f, 0xe8, 0xcf, 0x00, 0x80, 0xac, 0x86, 0xb9, 0x8b, 0x01, 0x00, 0x00,
 }
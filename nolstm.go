@@ -0,0 +1,28 @@
+//go:build !lstm
+// +build !lstm
+
+package main
+
+import (
+	"fmt"
+)
+
+// github.com/owulveryck/lstm does not build with current gorgonia,
+// lstm filter is only built with -tags lstm
+
+// LSTMFilter lstm filter placeholder
+type LSTMFilter struct{}
+
+// NewLSTMFilter lstm filter is not built
+func NewLSTMFilter(config map[string]string) (*LSTMFilter, error) {
+	return nil, fmt.Errorf("lstm filter is not built, build with -tags lstm")
+}
+
+// Handle pass msg
+func (lstmfilter *LSTMFilter) Handle(msg *map[string]interface{}) (*map[string]interface{}, error) {
+	return msg, nil
+}
+
+// Cleanup nothing
+func (lstmfilter *LSTMFilter) Cleanup() {
+}
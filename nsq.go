@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/nsqio/go-nsq"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -19,16 +22,35 @@ import (
 // "MaxInFlight":"10",
 // "Topic":"syslog",
 // "Channel":"aasa",
-// "LookupdAddresses":"127.0.0.1:4150,127.0.0.2:4151"
-// "Type":"elasticsearch"
+// "LookupdAddresses":"127.0.0.1:4161,127.0.0.2:4161",
+// "NSQDAddresses":"127.0.0.1:4150,127.0.0.2:4150",
+// "HandleTimeout":"60000",
+// "TouchInterval":"15000",
+// "RequeueDelay":"1000",
+// "MaxRequeueDelay":"60000",
+// "MaxAttempts":"5",
+// "TLS":"true",
+// "TLSCAFile":"/etc/nsq/ca.pem",
+// "TLSCertFile":"/etc/nsq/client.pem",
+// "TLSKeyFile":"/etc/nsq/client.key",
+// "TLSInsecureSkipVerify":"false",
+// "AuthSecret":"xxxx",
+// "Type":"nsq"
 // }
+// msg is finished when the task hands it to the output, requeued if the task rejects
+// it or HandleTimeout expires first, unparsable msg is finished and not redelivered
+// delivery is at most once after hand-off: output failure or buffer loss is not requeued,
+// use an output with SpoolDirectory or dead letter to keep failed msg
 
 // NSQReader nsq reader
 type NSQReader struct {
-	consumer     *nsq.Consumer
-	msgFormat    string
-	msgChan      chan *map[string][]byte
-	metricstatus *prometheus.CounterVec
+	consumer      *nsq.Consumer
+	msgFormat     string
+	msgChan       chan *map[string][]byte
+	pending       sync.Map
+	handleTimeout time.Duration
+	touchInterval time.Duration
+	metricstatus  *prometheus.CounterVec
 }
 
 // NewNSQReader create NSQReader
@@ -58,38 +80,124 @@ func NewNSQReader(config map[string]string) (*NSQReader, error) {
 		taskscount = 100
 	}
 	cfg.Set("max_in_flight", taskscount)
+	handleTimeout, err := strconv.Atoi(config["HandleTimeout"])
+	if err != nil || handleTimeout < 1000 {
+		handleTimeout = 60000
+	}
+	m.handleTimeout = time.Duration(handleTimeout) * time.Millisecond
+	touchInterval, err := strconv.Atoi(config["TouchInterval"])
+	if err != nil || touchInterval < 1000 {
+		touchInterval = 15000
+	}
+	m.touchInterval = time.Duration(touchInterval) * time.Millisecond
+	if requeueDelay, err := strconv.Atoi(config["RequeueDelay"]); err == nil {
+		cfg.Set("default_requeue_delay", requeueDelay)
+	}
+	if maxRequeueDelay, err := strconv.Atoi(config["MaxRequeueDelay"]); err == nil {
+		cfg.Set("max_requeue_delay", maxRequeueDelay)
+	}
+	if maxAttempts, err := strconv.Atoi(config["MaxAttempts"]); err == nil {
+		cfg.Set("max_attempts", maxAttempts)
+	}
+	if config["TLS"] == "true" {
+		cfg.Set("tls_v1", true)
+		if len(config["TLSCAFile"]) > 0 {
+			cfg.Set("tls_root_ca_file", config["TLSCAFile"])
+		}
+		if len(config["TLSCertFile"]) > 0 {
+			cfg.Set("tls_cert", config["TLSCertFile"])
+			cfg.Set("tls_key", config["TLSKeyFile"])
+		}
+		if config["TLSInsecureSkipVerify"] == "true" {
+			cfg.Set("tls_insecure_skip_verify", true)
+		}
+	}
+	if len(config["AuthSecret"]) > 0 {
+		cfg.Set("auth_secret", config["AuthSecret"])
+	}
+	if err = cfg.Validate(); err != nil {
+		return m, err
+	}
 	m.consumer, err = nsq.NewConsumer(config["Topic"], config["Channel"], cfg)
+	if err != nil {
+		return m, err
+	}
 	m.consumer.AddConcurrentHandlers(m, taskscount)
-	lookupds := strings.Split(config["LookupdAddresses"], ",")
-	err = m.consumer.ConnectToNSQLookupds(lookupds)
-	fmt.Println(config["Name"], "nsq reader is started")
+	if len(config["NSQDAddresses"]) > 0 {
+		err = m.consumer.ConnectToNSQDs(strings.Split(config["NSQDAddresses"], ","))
+	} else {
+		lookupds := strings.Split(config["LookupdAddresses"], ",")
+		err = m.consumer.ConnectToNSQLookupds(lookupds)
+	}
+	log.Println(config["Name"], "nsq reader is started")
 	return m, err
 }
 
 // HandleMessage handle msg
+// msg is finished after task accepted it or parser rejected it, requeued with backoff
+// if task failed to deliver it or not accepted in HandleTimeout
 func (m *NSQReader) HandleMessage(msg *nsq.Message) error {
-	var logFormat LogFormat
-	logmsg := make(map[string][]byte)
-	switch m.msgFormat {
-	case "protobuf":
-		err := proto.Unmarshal(msg.Body, &logFormat)
-		if err != nil {
-			log.Println("proto unmarshal", err, string(msg.Body))
-			m.metricstatus.WithLabelValues("protobuf", "failed").Inc()
+	format := "raw"
+	if m.msgFormat == "protobuf" {
+		format = "protobuf"
+	}
+	logmsg, err := DecodeLogMsg(m.msgFormat, msg.Body)
+	if err != nil {
+		log.Println("decode", format, err, string(msg.Body))
+		m.metricstatus.WithLabelValues(format, "failed").Inc()
+		return nil
+	}
+	m.metricstatus.WithLabelValues(format, "ok").Inc()
+	msgID := string(msg.ID[:])
+	logmsg["msgid"] = []byte(msgID)
+	result := make(chan error, 1)
+	m.pending.Store(msgID, result)
+	defer m.pending.Delete(msgID)
+	msg.DisableAutoResponse()
+	touchTicker := time.NewTicker(m.touchInterval)
+	defer touchTicker.Stop()
+	timeout := time.NewTimer(m.handleTimeout)
+	defer timeout.Stop()
+	msgChan := m.msgChan
+	for {
+		select {
+		case msgChan <- &logmsg:
+			// stop sending, wait for ack
+			msgChan = nil
+		case err := <-result:
+			if _, ok := err.(parseError); ok {
+				msg.Finish()
+				m.metricstatus.WithLabelValues(format, "unparsable").Inc()
+				return nil
+			}
+			if err != nil {
+				msg.Requeue(-1)
+				m.metricstatus.WithLabelValues(format, "requeue").Inc()
+				return nil
+			}
+			msg.Finish()
 			return nil
-		}
-		logmsg["msg"] = []byte(logFormat.GetRawmsg())
-		logmsg["from"] = []byte(logFormat.GetFrom())
-		if len(logmsg) < 1 {
+		case <-touchTicker.C:
+			msg.Touch()
+			m.metricstatus.WithLabelValues(format, "touch").Inc()
+		case <-timeout.C:
+			msg.Requeue(-1)
+			m.metricstatus.WithLabelValues(format, "timeout").Inc()
 			return nil
 		}
-		m.metricstatus.WithLabelValues("protobuf", "ok").Inc()
+	}
+}
+
+// Ack report task result of msg
+func (m *NSQReader) Ack(logmsg *map[string][]byte, err error) {
+	result, ok := m.pending.Load(string((*logmsg)["msgid"]))
+	if !ok {
+		return
+	}
+	select {
+	case result.(chan error) <- err:
 	default:
-		logmsg["msg"] = msg.Body
-		m.metricstatus.WithLabelValues("raw", "ok").Inc()
 	}
-	m.msgChan <- &logmsg
-	return nil
 }
 
 // Stop close all
@@ -106,18 +214,26 @@ func (m *NSQReader) GetMsgChan() chan *map[string][]byte {
 // {
 // "Topic":"xxxx",
 // "Name":"task",
-// "NSQAddress":"127.0.0.1:9200,172.17.0.1:9200",
+// "NSQAddress":"127.0.0.1:4150,172.17.0.1:4150",
+// "PublishStrategy":"failover",
 // "CompressionType":"snappy",
-// "BatchSize":"20"
+// "BatchSize":"20",
+// "FlushInterval":"1000",
+// "MaxRetry":"3"
 // }
 
 // NSQWriter nsq writer
 type NSQWriter struct {
-	producer     *nsq.Producer
-	Topic        string
-	BatchSize    int
-	exitChan     chan int
-	metricstatus *prometheus.CounterVec
+	producers     []*nsq.Producer
+	Topic         string
+	BatchSize     int
+	FlushInterval int
+	Strategy      string
+	current       uint64
+	guard         *SinkGuard
+	wg            sinkWaitGroup
+	exitChan      chan int
+	metricstatus  *prometheus.CounterVec
 }
 
 // NewNSQWriter create NSQWriter
@@ -125,12 +241,27 @@ func NewNSQWriter(config map[string]string) (*NSQWriter, error) {
 	nsqWriter := &NSQWriter{}
 	nsqWriter.Topic = config["Topic"]
 	nsqWriter.BatchSize, _ = strconv.Atoi(config["BatchSize"])
+	var err error
+	nsqWriter.FlushInterval, err = strconv.Atoi(config["FlushInterval"])
+	if err != nil || nsqWriter.FlushInterval < 100 {
+		nsqWriter.FlushInterval = 1000
+	}
+	nsqWriter.Strategy = config["PublishStrategy"]
+	if nsqWriter.Strategy != "roundrobin" {
+		nsqWriter.Strategy = "failover"
+	}
 	cfg := nsq.NewConfig()
 	hostname, err := os.Hostname()
 	cfg.Set("user_agent", fmt.Sprintf("%s/%s", config["Name"], hostname))
 	if config["CompressionType"] != "" {
 		cfg.Set(config["CompressionType"], true)
 	}
+	nsqWriter.guard = NewSinkGuard("nsq", config)
+	// publish can not be cancelled, bound it by socket timeouts instead
+	if nsqWriter.guard.AttemptTimeout > 0 {
+		cfg.Set("read_timeout", nsqWriter.guard.AttemptTimeout)
+		cfg.Set("write_timeout", nsqWriter.guard.AttemptTimeout)
+	}
 	nsqWriter.metricstatus = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Subsystem: "lazy_output",
@@ -139,28 +270,111 @@ func NewNSQWriter(config map[string]string) (*NSQWriter, error) {
 		},
 		[]string{"method"},
 	)
+	nsqWriter.exitChan = make(chan int)
+	for _, addr := range strings.Split(config["NSQAddress"], ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) == 0 {
+			continue
+		}
+		producer, err := nsq.NewProducer(addr, cfg)
+		if err != nil {
+			nsqWriter.stopProducers()
+			nsqWriter.guard.Close()
+			return nsqWriter, err
+		}
+		nsqWriter.producers = append(nsqWriter.producers, producer)
+	}
+	if len(nsqWriter.producers) == 0 {
+		nsqWriter.guard.Close()
+		return nsqWriter, fmt.Errorf("no nsqd address")
+	}
 	// Register status
 	prometheus.Register(nsqWriter.metricstatus)
-	nsqWriter.exitChan = make(chan int)
-	nsqWriter.producer, err = nsq.NewProducer(config["NSQAddress"], cfg)
-	return nsqWriter, err
+	return nsqWriter, nil
 }
 
 // Stop close all
 func (nsqWriter *NSQWriter) Stop() {
-	nsqWriter.producer.Stop()
 	close(nsqWriter.exitChan)
+	// wait for pending batches to be flushed
+	nsqWriter.wg.Wait()
+	nsqWriter.guard.Close()
+	nsqWriter.stopProducers()
 	log.Println("exit nsq producer")
 	prometheus.Unregister(nsqWriter.metricstatus)
 }
 
+func (nsqWriter *NSQWriter) stopProducers() {
+	for _, producer := range nsqWriter.producers {
+		producer.Stop()
+	}
+}
+
+// nextProducer pick producer for the attempt
+// failover sticks to the last healthy producer, roundrobin rotates per publish
+func (nsqWriter *NSQWriter) nextProducer() (uint64, *nsq.Producer) {
+	var index uint64
+	if nsqWriter.Strategy == "roundrobin" {
+		index = atomic.AddUint64(&nsqWriter.current, 1)
+	} else {
+		index = atomic.LoadUint64(&nsqWriter.current)
+	}
+	index = index % uint64(len(nsqWriter.producers))
+	return index, nsqWriter.producers[index]
+}
+
+// publish send body to nsqd, SinkGuard retry on other producers if failed
+func (nsqWriter *NSQWriter) publish(body [][]byte) error {
+	if len(body) == 0 {
+		return nil
+	}
+	err := nsqWriter.guard.Do(func(ctx context.Context) error {
+		var err error
+		index, producer := nsqWriter.nextProducer()
+		if len(body) == 1 {
+			err = producer.Publish(nsqWriter.Topic, body[0])
+			if err == nil {
+				nsqWriter.metricstatus.WithLabelValues("publish").Inc()
+				return nil
+			}
+		} else {
+			err = producer.MultiPublish(nsqWriter.Topic, body)
+			if err == nil {
+				nsqWriter.metricstatus.WithLabelValues("multipublish").Inc()
+				return nil
+			}
+		}
+		nsqWriter.metricstatus.WithLabelValues("failed").Inc()
+		log.Println("nsq publish error", producer.String(), err)
+		if nsqWriter.Strategy == "failover" {
+			atomic.StoreUint64(&nsqWriter.current, (index+1)%uint64(len(nsqWriter.producers)))
+		}
+		return err
+	})
+	if err != nil {
+		nsqWriter.metricstatus.WithLabelValues("dropped").Add(float64(len(body)))
+	}
+	return err
+}
+
 // Start run task
 func (nsqWriter *NSQWriter) Start(dataChan chan *map[string]interface{}) {
+	if !nsqWriter.wg.Add() {
+		return
+	}
+	defer nsqWriter.wg.Done()
 	var body [][]byte
+	ticker := time.NewTicker(time.Duration(nsqWriter.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-nsqWriter.exitChan:
+			nsqWriter.publish(body)
 			return
+		case <-ticker.C:
+			nsqWriter.publish(body)
+			// a new batch, never reuse the array of a published one
+			body = nil
 		case logmsg := <-dataChan:
 			var item []byte
 			switch (*logmsg)["rawmsg"].(type) {
@@ -170,16 +384,14 @@ func (nsqWriter *NSQWriter) Start(dataChan chan *map[string]interface{}) {
 				item = (*logmsg)["rawmsg"].([]byte)
 			}
 			if nsqWriter.BatchSize > 1 {
+				body = append(body, item)
 				if len(body) < nsqWriter.BatchSize {
-					body = append(body, item)
 					break
 				}
-				nsqWriter.producer.MultiPublish(nsqWriter.Topic, body)
-				body = body[:0]
-				nsqWriter.metricstatus.WithLabelValues("multipublish").Inc()
+				nsqWriter.publish(body)
+				body = nil
 			} else {
-				nsqWriter.producer.Publish(nsqWriter.Topic, item)
-				nsqWriter.metricstatus.WithLabelValues("publish").Inc()
+				nsqWriter.publish([][]byte{item})
 			}
 		}
 	}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// config
+// {
+// "Directory":"/archive/parquet",
+// "Schema":"parser",
+// "Compression":"snappy",
+// "RowGroupSize":"128",
+// "RowsPerFile":"1000000",
+// "FileInterval":"600",
+// "Type":"parquet"
+// }
+// files are written to Directory/task/yyyy-mm-dd/hh/part-xxx.parquet by event timestamp
+// Schema parser use LogParser TokenFormat, infer use fields of the first event,
+// parser falls back to infer when the parser has no tokens
+// RowGroupSize in MB, FileInterval in seconds
+// file is written as .tmp and renamed when finished
+
+type parquetColumn struct {
+	name   string
+	format string
+}
+
+type parquetFile struct {
+	path    string
+	tmpPath string
+	file    source.ParquetFile
+	writer  *writer.JSONWriter
+	rows    int
+	created time.Time
+}
+
+// ParquetWriter write msg to local parquet files
+type ParquetWriter struct {
+	sync.Mutex
+	Directory    string
+	Taskname     string
+	Compression  parquet.CompressionCodec
+	RowGroupSize int64
+	RowsPerFile  int
+	FileInterval time.Duration
+	columns      []parquetColumn
+	schema       string
+	files        map[string]*parquetFile
+	seq          int
+	wg           sinkWaitGroup
+	exitChan     chan int
+	metricstatus *prometheus.CounterVec
+}
+
+// NewParquetWriter create ParquetWriter
+func NewParquetWriter(config map[string]string, parser *LogParser) (*ParquetWriter, error) {
+	w := &ParquetWriter{
+		Directory: config["Directory"],
+		Taskname:  config["Taskname"],
+	}
+	if len(w.Directory) == 0 {
+		return w, fmt.Errorf("no parquet directory")
+	}
+	switch config["Compression"] {
+	case "gzip":
+		w.Compression = parquet.CompressionCodec_GZIP
+	case "zstd":
+		w.Compression = parquet.CompressionCodec_ZSTD
+	case "none":
+		w.Compression = parquet.CompressionCodec_UNCOMPRESSED
+	default:
+		w.Compression = parquet.CompressionCodec_SNAPPY
+	}
+	rowGroupSize, err := strconv.Atoi(config["RowGroupSize"])
+	if err != nil || rowGroupSize < 1 {
+		rowGroupSize = 128
+	}
+	w.RowGroupSize = int64(rowGroupSize) * 1024 * 1024
+	w.RowsPerFile, err = strconv.Atoi(config["RowsPerFile"])
+	if err != nil || w.RowsPerFile < 1 {
+		w.RowsPerFile = 1000000
+	}
+	interval, err := strconv.Atoi(config["FileInterval"])
+	if err != nil || interval < 10 {
+		interval = 600
+	}
+	w.FileInterval = time.Duration(interval) * time.Second
+	if config["Schema"] != "infer" {
+		if parser == nil {
+			return w, fmt.Errorf("no LogParser for parquet schema")
+		}
+		// parser without Tokens has no columns but timestamp, infer them instead
+		if schema := parser.Schema(); len(schema) > 1 {
+			w.setColumns(schema)
+		} else {
+			log.Println("parquet writer: empty parser schema, infer from first event")
+		}
+	}
+	w.files = make(map[string]*parquetFile)
+	w.exitChan = make(chan int)
+	w.metricstatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "lazy_output",
+			Name:      fmt.Sprintf("parquet_writer_%s", config["Taskname"]),
+			Help:      "parquet writer status.",
+		},
+		[]string{"method"},
+	)
+	// Register status
+	prometheus.Register(w.metricstatus)
+	go w.closeLoop()
+	return w, nil
+}
+
+// setColumns build parquet json schema, all columns are optional
+func (w *ParquetWriter) setColumns(schema map[string]string) {
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	type field struct {
+		Tag string `json:"Tag"`
+	}
+	root := struct {
+		Tag    string  `json:"Tag"`
+		Fields []field `json:"Fields"`
+	}{Tag: "name=parquet_go_root"}
+	w.columns = w.columns[:0]
+	for _, name := range names {
+		var typ string
+		switch schema[name] {
+		case "int":
+			typ = "INT64"
+		case "float":
+			typ = "DOUBLE"
+		case "bool":
+			typ = "BOOLEAN"
+		case "nginxtimestamp", "time":
+			typ = "TIMESTAMP_MILLIS"
+		default:
+			typ = "UTF8"
+		}
+		w.columns = append(w.columns, parquetColumn{name: name, format: schema[name]})
+		root.Fields = append(root.Fields, field{Tag: fmt.Sprintf("name=%s, type=%s, repetitiontype=OPTIONAL", name, typ)})
+	}
+	data, _ := json.Marshal(root)
+	w.schema = string(data)
+}
+
+// inferSchema get field types from msg
+func inferSchema(msg *map[string]interface{}) map[string]string {
+	schema := make(map[string]string)
+	for k, v := range *msg {
+		switch v.(type) {
+		case int, int32, int64:
+			schema[k] = "int"
+		case float32, float64:
+			schema[k] = "float"
+		case bool:
+			schema[k] = "bool"
+		case time.Time:
+			schema[k] = "time"
+		default:
+			schema[k] = "string"
+		}
+	}
+	return schema
+}
+
+// record convert msg to json row of schema
+func (w *ParquetWriter) record(msg *map[string]interface{}) (string, error) {
+	row := make(map[string]interface{})
+	for _, column := range w.columns {
+		value, ok := (*msg)[column.name]
+		if !ok {
+			continue
+		}
+		switch column.format {
+		case "int":
+			switch v := value.(type) {
+			case int:
+				row[column.name] = int64(v)
+			case int32:
+				row[column.name] = int64(v)
+			case int64:
+				row[column.name] = v
+			case float64:
+				row[column.name] = int64(v)
+			}
+		case "float":
+			switch v := value.(type) {
+			case float32:
+				row[column.name] = float64(v)
+			case float64:
+				row[column.name] = v
+			case int64:
+				row[column.name] = float64(v)
+			}
+		case "bool":
+			if v, ok := value.(bool); ok {
+				row[column.name] = v
+			}
+		case "nginxtimestamp", "time":
+			if v, ok := value.(time.Time); ok {
+				row[column.name] = v.UnixNano() / int64(time.Millisecond)
+			}
+		default:
+			switch v := value.(type) {
+			case string:
+				row[column.name] = v
+			case []byte, int, int32, int64, float32, float64, bool, time.Time:
+				row[column.name] = FormatValue(v)
+			default:
+				data, err := json.Marshal(v)
+				if err == nil {
+					row[column.name] = string(data)
+				}
+			}
+		}
+	}
+	data, err := json.Marshal(row)
+	return string(data), err
+}
+
+// Stop finish all files
+func (w *ParquetWriter) Stop() {
+	close(w.exitChan)
+	w.wg.Wait()
+	w.Lock()
+	for partition, f := range w.files {
+		w.finish(f)
+		delete(w.files, partition)
+	}
+	w.Unlock()
+	log.Println("exit parquet writer")
+	prometheus.Unregister(w.metricstatus)
+}
+
+// Start run writer
+func (w *ParquetWriter) Start(dataChan chan *map[string]interface{}) {
+	if !w.wg.Add() {
+		return
+	}
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.exitChan:
+			return
+		case logmsg := <-dataChan:
+			if err := w.write(logmsg); err != nil {
+				log.Println("parquet writer", err)
+				w.metricstatus.WithLabelValues("failed").Inc()
+				break
+			}
+			w.metricstatus.WithLabelValues("written").Inc()
+		}
+	}
+}
+
+func (w *ParquetWriter) write(msg *map[string]interface{}) error {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.columns) == 0 {
+		w.setColumns(inferSchema(msg))
+	}
+	ts, ok := (*msg)["timestamp"].(time.Time)
+	if !ok {
+		ts = time.Now()
+	}
+	partition := filepath.Join(w.Directory, w.Taskname, ts.Format("2006-01-02"), ts.Format("15"))
+	f, ok := w.files[partition]
+	if !ok {
+		var err error
+		f, err = w.create(partition)
+		if err != nil {
+			return err
+		}
+		w.files[partition] = f
+	}
+	record, err := w.record(msg)
+	if err != nil {
+		return err
+	}
+	if err = f.writer.Write(record); err != nil {
+		return err
+	}
+	f.rows++
+	if f.rows >= w.RowsPerFile {
+		w.finish(f)
+		delete(w.files, partition)
+	}
+	return nil
+}
+
+func (w *ParquetWriter) create(partition string) (*parquetFile, error) {
+	if err := os.MkdirAll(partition, 0755); err != nil {
+		return nil, err
+	}
+	w.seq++
+	name := fmt.Sprintf("part-%d-%d.parquet", time.Now().UnixNano(), w.seq)
+	f := &parquetFile{
+		path:    filepath.Join(partition, name),
+		tmpPath: filepath.Join(partition, "."+name+".tmp"),
+		created: time.Now(),
+	}
+	var err error
+	f.file, err = local.NewLocalFileWriter(f.tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	f.writer, err = writer.NewJSONWriter(w.schema, f.file, 1)
+	if err != nil {
+		f.file.Close()
+		os.Remove(f.tmpPath)
+		return nil, err
+	}
+	f.writer.RowGroupSize = w.RowGroupSize
+	f.writer.CompressionType = w.Compression
+	return f, nil
+}
+
+// finish write footer, sync and rename tmp file
+func (w *ParquetWriter) finish(f *parquetFile) {
+	err := f.writer.WriteStop()
+	if lf, ok := f.file.(*local.LocalFile); ok && err == nil {
+		err = lf.File.Sync()
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.tmpPath, f.path)
+	}
+	if err != nil {
+		log.Println("parquet finish", f.path, err)
+		w.metricstatus.WithLabelValues("finish_failed").Inc()
+		return
+	}
+	w.metricstatus.WithLabelValues("finished").Inc()
+}
+
+// closeLoop finish files opened longer than FileInterval
+func (w *ParquetWriter) closeLoop() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.exitChan:
+			return
+		case <-ticker.C:
+			w.Lock()
+			for partition, f := range w.files {
+				if time.Since(f.created) >= w.FileInterval {
+					w.finish(f)
+					delete(w.files, partition)
+				}
+			}
+			w.Unlock()
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"regexp"
 )
 
@@ -40,7 +41,7 @@ func NewRegexpFilter(config map[string]string) (*RegexpFilter, error) {
 		rf.regexpList[k], err = regexp.CompilePOSIX(v)
 		if err != nil {
 			delete(rf.regexpList, k)
-			fmt.Println(k, v, err)
+			log.Println(k, v, err)
 		}
 	}
 	if len(rf.regexpList) == 0 {
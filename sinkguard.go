@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// config, read from OutputSetting
+// {
+// "MaxRetry":"3",
+// "RetryBackoff":"500",
+// "RetryMaxBackoff":"30000",
+// "AttemptTimeout":"0",
+// "BreakerThreshold":"5",
+// "BreakerCooldown":"30000"
+// }
+// failed attempts are retried MaxRetry times with exponential backoff and jitter,
+// every attempt gets a context with AttemptTimeout ms deadline (0, the default, disable it),
+// an attempt is always waited for before the next one, so a write is never in flight twice
+// BreakerThreshold failures in a row open the circuit for BreakerCooldown ms,
+// then one attempt is allowed (half-open) to close it again
+// circuit state gauge: 0 closed, 1 open, 2 half-open
+//
+// outputs and the keys they honor:
+// http, influxdb, loki, clickhouse, sql: all keys, AttemptTimeout cancel the request
+// elasticsearch: all keys, AttemptTimeout defaults to Timeout (30000), MaxRetry also
+// bounds items rejected with 429/503, failed batches are spooled or retried until stop
+// nsq: all keys, AttemptTimeout set nsqd read/write timeouts
+// kafka: all keys, AttemptTimeout set Producer.Timeout, input is paused while circuit is open,
+// the first msg after cooldown is the half-open probe
+// file: MaxRetry, RetryBackoff, RetryMaxBackoff, Breaker*, local writes are not cancelled
+// syslog: AttemptTimeout (write deadline) and Breaker*, failed msg is buffered instead of retried
+// mqtt, statsd, stdout and parquet are not guarded, mqtt has its own buffer and PublishTimeout
+
+// circuit states
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// ErrCircuitOpen attempt rejected by open circuit
+var ErrCircuitOpen = errors.New("circuit open")
+
+type permanentError struct {
+	error
+}
+
+// Permanent mark error as not retriable, sink is still healthy
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+type retryAfterError struct {
+	error
+	delay time.Duration
+}
+
+// RetryAfter mark error as retriable after delay
+func RetryAfter(err error, delay time.Duration) error {
+	return retryAfterError{err, delay}
+}
+
+// SinkGuard retry and circuit breaker for output writes
+type SinkGuard struct {
+	sync.Mutex
+	Name           string
+	MaxRetry       int
+	Backoff        time.Duration
+	MaxBackoff     time.Duration
+	AttemptTimeout time.Duration
+	Threshold      int
+	Cooldown       time.Duration
+	state          int
+	failures       int
+	openedAt       time.Time
+	trial          bool
+	exitChan       chan int
+	abortOnce      sync.Once
+	ctx            context.Context
+	cancel         context.CancelFunc
+	circuitstatus  *prometheus.GaugeVec
+	metricstatus   *prometheus.CounterVec
+}
+
+// NewSinkGuard create SinkGuard for output name
+func NewSinkGuard(name string, config map[string]string) *SinkGuard {
+	g := &SinkGuard{Name: name}
+	var err error
+	g.MaxRetry, err = strconv.Atoi(config["MaxRetry"])
+	if err != nil || g.MaxRetry < 0 {
+		g.MaxRetry = 3
+	}
+	backoff, err := strconv.Atoi(config["RetryBackoff"])
+	if err != nil || backoff < 10 {
+		backoff = 500
+	}
+	g.Backoff = time.Duration(backoff) * time.Millisecond
+	maxBackoff, err := strconv.Atoi(config["RetryMaxBackoff"])
+	if err != nil || maxBackoff < backoff {
+		maxBackoff = 30000
+	}
+	g.MaxBackoff = time.Duration(maxBackoff) * time.Millisecond
+	timeout, err := strconv.Atoi(config["AttemptTimeout"])
+	if err != nil || timeout < 0 {
+		timeout = 0
+	}
+	g.AttemptTimeout = time.Duration(timeout) * time.Millisecond
+	g.Threshold, err = strconv.Atoi(config["BreakerThreshold"])
+	if err != nil || g.Threshold < 1 {
+		g.Threshold = 5
+	}
+	cooldown, err := strconv.Atoi(config["BreakerCooldown"])
+	if err != nil || cooldown < 100 {
+		cooldown = 30000
+	}
+	g.Cooldown = time.Duration(cooldown) * time.Millisecond
+	g.exitChan = make(chan int)
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	g.circuitstatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "lazy_output",
+			Name:      fmt.Sprintf("circuit_state_%s", config["Taskname"]),
+			Help:      "output circuit state, 0 closed, 1 open, 2 half-open.",
+		},
+		[]string{"sink"},
+	)
+	g.metricstatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "lazy_output",
+			Name:      fmt.Sprintf("circuit_%s", config["Taskname"]),
+			Help:      "output retry and circuit events.",
+		},
+		[]string{"sink", "event"},
+	)
+	// Register status
+	prometheus.Register(g.circuitstatus)
+	prometheus.Register(g.metricstatus)
+	g.circuitstatus.WithLabelValues(g.Name).Set(circuitClosed)
+	return g
+}
+
+// guardConfig copy config with output defaults for empty SinkGuard keys,
+// config of the task is not changed
+func guardConfig(config map[string]string, defaults map[string]string) map[string]string {
+	c := make(map[string]string, len(config)+len(defaults))
+	for k, v := range config {
+		c[k] = v
+	}
+	for k, v := range defaults {
+		if len(c[k]) == 0 {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+// Abort stop waiting retries and cancel attempt in flight
+func (g *SinkGuard) Abort() {
+	g.abortOnce.Do(func() {
+		close(g.exitChan)
+		g.cancel()
+	})
+}
+
+// Close abort and unregister metrics
+func (g *SinkGuard) Close() {
+	g.Abort()
+	prometheus.Unregister(g.circuitstatus)
+	prometheus.Unregister(g.metricstatus)
+}
+
+// Do run fn until success, permanent error, MaxRetry or Abort
+// fn must give up when ctx is done
+func (g *SinkGuard) Do(fn func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		err := g.Try(fn)
+		if err == nil {
+			return nil
+		}
+		if e, ok := err.(permanentError); ok {
+			g.metricstatus.WithLabelValues(g.Name, "permanent").Inc()
+			return e.error
+		}
+		if attempt >= g.MaxRetry {
+			g.metricstatus.WithLabelValues(g.Name, "exhausted").Inc()
+			return err
+		}
+		delay := g.RetryBackoff(attempt)
+		if e, ok := err.(retryAfterError); ok && e.delay > delay {
+			delay = e.delay
+		}
+		if err == ErrCircuitOpen {
+			if wait := g.cooldownLeft(); wait > delay {
+				delay = wait
+			}
+		}
+		g.metricstatus.WithLabelValues(g.Name, "retry").Inc()
+		select {
+		case <-time.After(delay):
+		case <-g.exitChan:
+			return err
+		}
+	}
+}
+
+// Try run fn once with circuit check and timeout, fn is waited for
+func (g *SinkGuard) Try(fn func(ctx context.Context) error) error {
+	if !g.Allow() {
+		g.metricstatus.WithLabelValues(g.Name, "rejected").Inc()
+		return ErrCircuitOpen
+	}
+	ctx, cancel := g.Context()
+	defer cancel()
+	err := fn(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		g.metricstatus.WithLabelValues(g.Name, "timeout").Inc()
+	}
+	if _, ok := err.(permanentError); ok {
+		g.Record(nil)
+	} else {
+		g.Record(err)
+	}
+	return err
+}
+
+// Context context of one attempt, with AttemptTimeout deadline if set,
+// it is cancelled by Abort
+func (g *SinkGuard) Context() (context.Context, context.CancelFunc) {
+	if g.AttemptTimeout > 0 {
+		return context.WithTimeout(g.ctx, g.AttemptTimeout)
+	}
+	return context.WithCancel(g.ctx)
+}
+
+// RetryBackoff exponential backoff of attempt with jitter
+func (g *SinkGuard) RetryBackoff(attempt int) time.Duration {
+	delay := g.MaxBackoff
+	if attempt < 30 && g.Backoff<<uint(attempt) < g.MaxBackoff {
+		delay = g.Backoff << uint(attempt)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Allow check circuit before an attempt, open circuit turns half-open after Cooldown
+func (g *SinkGuard) Allow() bool {
+	g.Lock()
+	defer g.Unlock()
+	switch g.state {
+	case circuitOpen:
+		if time.Since(g.openedAt) < g.Cooldown {
+			return false
+		}
+		g.setState(circuitHalfOpen)
+		g.trial = true
+		return true
+	case circuitHalfOpen:
+		if g.trial {
+			return false
+		}
+		g.trial = true
+		return true
+	}
+	return true
+}
+
+// IsOpen check circuit without starting half-open trial
+func (g *SinkGuard) IsOpen() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.state == circuitOpen && time.Since(g.openedAt) < g.Cooldown
+}
+
+// Record update circuit by attempt result
+func (g *SinkGuard) Record(err error) {
+	g.Lock()
+	defer g.Unlock()
+	g.trial = false
+	if err == nil {
+		g.failures = 0
+		if g.state != circuitClosed {
+			g.setState(circuitClosed)
+			g.metricstatus.WithLabelValues(g.Name, "closed").Inc()
+		}
+		return
+	}
+	g.failures++
+	g.metricstatus.WithLabelValues(g.Name, "failed").Inc()
+	// failure after cooldown without a half-open trial, open again
+	if g.state == circuitOpen && time.Since(g.openedAt) >= g.Cooldown {
+		g.openedAt = time.Now()
+		g.metricstatus.WithLabelValues(g.Name, "tripped").Inc()
+		return
+	}
+	if g.state == circuitHalfOpen || g.state == circuitClosed && g.failures >= g.Threshold {
+		g.setState(circuitOpen)
+		g.openedAt = time.Now()
+		g.metricstatus.WithLabelValues(g.Name, "tripped").Inc()
+	}
+}
+
+func (g *SinkGuard) cooldownLeft() time.Duration {
+	g.Lock()
+	defer g.Unlock()
+	if g.state != circuitOpen {
+		return 0
+	}
+	return g.Cooldown - time.Since(g.openedAt)
+}
+
+// setState must hold lock
+func (g *SinkGuard) setState(state int) {
+	g.state = state
+	g.circuitstatus.WithLabelValues(g.Name).Set(float64(state))
+}
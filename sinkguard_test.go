@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestGuard(config map[string]string) *SinkGuard {
+	config["Taskname"] = fmt.Sprintf("test_%d", time.Now().UnixNano())
+	return NewSinkGuard("test", config)
+}
+
+func TestSinkGuardCircuit(t *testing.T) {
+	failed := errors.New("failed")
+	// op: fail, ok, allow, deny, cooldown
+	tests := []struct {
+		name  string
+		ops   []string
+		state int
+	}{
+		{"closed below threshold", []string{"fail", "fail"}, circuitClosed},
+		{"success reset failures", []string{"fail", "fail", "ok", "fail", "fail"}, circuitClosed},
+		{"open at threshold", []string{"fail", "fail", "fail", "deny"}, circuitOpen},
+		{"half-open after cooldown", []string{"fail", "fail", "fail", "cooldown", "allow"}, circuitHalfOpen},
+		{"half-open allow one trial", []string{"fail", "fail", "fail", "cooldown", "allow", "deny"}, circuitHalfOpen},
+		{"half-open success close", []string{"fail", "fail", "fail", "cooldown", "allow", "ok", "allow"}, circuitClosed},
+		{"half-open failure open", []string{"fail", "fail", "fail", "cooldown", "allow", "fail", "deny"}, circuitOpen},
+		{"failure after cooldown open", []string{"fail", "fail", "fail", "cooldown", "fail", "deny"}, circuitOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGuard(map[string]string{"BreakerThreshold": "3", "BreakerCooldown": "100"})
+			defer g.Close()
+			for i, op := range tt.ops {
+				switch op {
+				case "fail":
+					g.Record(failed)
+				case "ok":
+					g.Record(nil)
+				case "allow", "deny":
+					if allowed := g.Allow(); allowed != (op == "allow") {
+						t.Fatalf("op %d %s: Allow() = %v", i, op, allowed)
+					}
+				case "cooldown":
+					time.Sleep(g.Cooldown + 10*time.Millisecond)
+				}
+			}
+			if g.state != tt.state {
+				t.Errorf("state = %d, want %d", g.state, tt.state)
+			}
+		})
+	}
+}
+
+func TestSinkGuardReopenAfterCooldown(t *testing.T) {
+	g := newTestGuard(map[string]string{"BreakerThreshold": "1", "BreakerCooldown": "100"})
+	defer g.Close()
+	g.Record(errors.New("failed"))
+	if !g.IsOpen() {
+		t.Fatal("circuit not open after threshold")
+	}
+	time.Sleep(g.Cooldown + 10*time.Millisecond)
+	if g.IsOpen() {
+		t.Fatal("circuit open after cooldown")
+	}
+	g.Record(errors.New("failed"))
+	if !g.IsOpen() {
+		t.Fatal("circuit not open after failure past cooldown")
+	}
+}
+
+func TestSinkGuardDo(t *testing.T) {
+	failed := errors.New("failed")
+	tests := []struct {
+		name  string
+		errs  []error
+		calls int
+		err   error
+	}{
+		{"success", []error{nil}, 1, nil},
+		{"retry then success", []error{failed, failed, nil}, 3, nil},
+		{"exhausted", []error{failed, failed, failed, failed}, 3, failed},
+		{"permanent", []error{Permanent(failed)}, 1, failed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGuard(map[string]string{"MaxRetry": "2", "RetryBackoff": "10", "BreakerThreshold": "10"})
+			defer g.Close()
+			calls := 0
+			err := g.Do(func(ctx context.Context) error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if err != tt.err {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+			if calls != tt.calls {
+				t.Errorf("calls = %d, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestSinkGuardAbort(t *testing.T) {
+	g := newTestGuard(map[string]string{"MaxRetry": "5", "RetryBackoff": "10000"})
+	defer g.Close()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		g.Abort()
+	}()
+	start := time.Now()
+	if err := g.Do(func(ctx context.Context) error { return errors.New("failed") }); err == nil {
+		t.Fatal("Do succeeded after abort")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Do waited %s after abort", time.Since(start))
+	}
+}
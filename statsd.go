@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// config
+// {
+// "Address":"127.0.0.1:8125",
+// "Prefix":"lazy.nginx",
+// "Tags":"Host,Status",
+// "DogStatsD":"true",
+// "Counters":"requests",
+// "Timers":"request_time=RequestTime",
+// "TimerScale":"1000",
+// "TimerSampleSize":"1000",
+// "Gauges":"body_bytes=BodyBytesSent",
+// "FlushInterval":"10000",
+// "MaxPacketSize":"1432",
+// "Type":"statsd"
+// }
+// Counters count events, Timers and Gauges are name=field
+// timer values are multiplied by TimerScale (seconds to ms)
+// metrics are aggregated per tag set and sent every FlushInterval
+// Tags are sent as dogstatsd tags or appended to metric name
+// it works as output or as task side output with "StatsdAddr" and "Statsd" settings
+
+type statsdMetric struct {
+	name  string
+	field string
+}
+
+type statsdTimer struct {
+	samples []float64
+	count   int
+}
+
+// StatsdWriter emit statsd metrics from msg fields
+type StatsdWriter struct {
+	sync.Mutex
+	Address         string
+	Prefix          string
+	Tags            []string
+	DogStatsD       bool
+	Counters        []string
+	Timers          []statsdMetric
+	Gauges          []statsdMetric
+	TimerScale      float64
+	TimerSampleSize int
+	FlushInterval   int
+	MaxPacketSize   int
+	conn            net.Conn
+	counters        map[string]int64
+	timers          map[string]*statsdTimer
+	gauges          map[string]float64
+	exitChan        chan int
+	metricstatus    *prometheus.CounterVec
+}
+
+func parseStatsdMetrics(setting string) []statsdMetric {
+	var metrics []statsdMetric
+	for _, item := range splitKeys(setting) {
+		items := strings.SplitN(item, "=", 2)
+		if len(items) == 2 {
+			metrics = append(metrics, statsdMetric{name: strings.TrimSpace(items[0]), field: strings.TrimSpace(items[1])})
+		}
+	}
+	return metrics
+}
+
+// NewStatsdWriter create StatsdWriter
+func NewStatsdWriter(config map[string]string) (*StatsdWriter, error) {
+	w := &StatsdWriter{
+		Address:   config["Address"],
+		Prefix:    strings.TrimRight(config["Prefix"], "."),
+		DogStatsD: config["DogStatsD"] == "true",
+	}
+	if len(w.Address) == 0 {
+		return w, fmt.Errorf("no statsd address")
+	}
+	w.Tags = splitKeys(config["Tags"])
+	w.Counters = splitKeys(config["Counters"])
+	w.Timers = parseStatsdMetrics(config["Timers"])
+	w.Gauges = parseStatsdMetrics(config["Gauges"])
+	if len(w.Counters) == 0 && len(w.Timers) == 0 && len(w.Gauges) == 0 {
+		return w, fmt.Errorf("no statsd metrics")
+	}
+	var err error
+	w.TimerScale, err = strconv.ParseFloat(config["TimerScale"], 64)
+	if err != nil || w.TimerScale <= 0 {
+		w.TimerScale = 1000
+	}
+	w.TimerSampleSize, err = strconv.Atoi(config["TimerSampleSize"])
+	if err != nil || w.TimerSampleSize < 1 {
+		w.TimerSampleSize = 1000
+	}
+	w.FlushInterval, err = strconv.Atoi(config["FlushInterval"])
+	if err != nil || w.FlushInterval < 1000 {
+		w.FlushInterval = 10000
+	}
+	w.MaxPacketSize, err = strconv.Atoi(config["MaxPacketSize"])
+	if err != nil || w.MaxPacketSize < 512 {
+		w.MaxPacketSize = 1432
+	}
+	w.conn, err = net.Dial("udp", w.Address)
+	if err != nil {
+		return w, err
+	}
+	w.counters = make(map[string]int64)
+	w.timers = make(map[string]*statsdTimer)
+	w.gauges = make(map[string]float64)
+	w.exitChan = make(chan int)
+	w.metricstatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "lazy_output",
+			Name:      fmt.Sprintf("statsd_writer_%s", config["Taskname"]),
+			Help:      "statsd writer status.",
+		},
+		[]string{"method"},
+	)
+	// Register status
+	prometheus.Register(w.metricstatus)
+	go w.flushLoop()
+	return w, nil
+}
+
+// Stop flush and close
+func (w *StatsdWriter) Stop() {
+	close(w.exitChan)
+	w.flush()
+	w.conn.Close()
+	prometheus.Unregister(w.metricstatus)
+}
+
+// Start run writer
+func (w *StatsdWriter) Start(dataChan chan *map[string]interface{}) {
+	for {
+		select {
+		case <-w.exitChan:
+			return
+		case logmsg := <-dataChan:
+			w.Handle(logmsg)
+		}
+	}
+}
+
+func statsdFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func statsdSanitize(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// suffix build tag part of metric key
+func (w *StatsdWriter) suffix(msg *map[string]interface{}) string {
+	if len(w.Tags) == 0 {
+		return ""
+	}
+	tags := make([]string, 0, len(w.Tags))
+	for _, k := range w.Tags {
+		value, ok := LookupField(msg, k)
+		if !ok || len(value) == 0 {
+			continue
+		}
+		if w.DogStatsD {
+			tags = append(tags, fmt.Sprintf("%s:%s", statsdSanitize(k), statsdSanitize(value)))
+		} else {
+			tags = append(tags, strings.Replace(statsdSanitize(value), ".", "_", -1))
+		}
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	if w.DogStatsD {
+		return "|#" + strings.Join(tags, ",")
+	}
+	return "." + strings.Join(tags, ".")
+}
+
+func (w *StatsdWriter) key(name, suffix string) string {
+	if len(w.Prefix) > 0 {
+		name = w.Prefix + "." + name
+	}
+	// dogstatsd key is name|#tags, type is inserted before tags when sending
+	return name + suffix
+}
+
+// Handle aggregate metrics of msg
+func (w *StatsdWriter) Handle(msg *map[string]interface{}) {
+	suffix := w.suffix(msg)
+	w.Lock()
+	defer w.Unlock()
+	for _, name := range w.Counters {
+		w.counters[w.key(name, suffix)]++
+	}
+	for _, m := range w.Timers {
+		value, ok := LookupValue(msg, m.field)
+		if !ok {
+			continue
+		}
+		f, ok := statsdFloat(value)
+		if !ok {
+			continue
+		}
+		key := w.key(m.name, suffix)
+		timer, ok := w.timers[key]
+		if !ok {
+			timer = &statsdTimer{}
+			w.timers[key] = timer
+		}
+		timer.count++
+		// reservoir sampling keeps TimerSampleSize samples
+		if len(timer.samples) < w.TimerSampleSize {
+			timer.samples = append(timer.samples, f*w.TimerScale)
+		} else if i := rand.Intn(timer.count); i < w.TimerSampleSize {
+			timer.samples[i] = f * w.TimerScale
+		}
+	}
+	for _, m := range w.Gauges {
+		value, ok := LookupValue(msg, m.field)
+		if !ok {
+			continue
+		}
+		if f, ok := statsdFloat(value); ok {
+			w.gauges[w.key(m.name, suffix)] = f
+		}
+	}
+}
+
+// line format name:value|type|@rate|#tags
+func (w *StatsdWriter) line(key, value, typ string, rate float64) string {
+	name, tags := key, ""
+	if w.DogStatsD {
+		if i := strings.Index(key, "|#"); i >= 0 {
+			name, tags = key[:i], key[i:]
+		}
+	}
+	if rate < 1 {
+		return fmt.Sprintf("%s:%s|%s|@%s%s", name, value, typ, strconv.FormatFloat(rate, 'f', 6, 64), tags)
+	}
+	return fmt.Sprintf("%s:%s|%s%s", name, value, typ, tags)
+}
+
+func (w *StatsdWriter) flush() {
+	w.Lock()
+	counters, timers, gauges := w.counters, w.timers, w.gauges
+	w.counters = make(map[string]int64)
+	w.timers = make(map[string]*statsdTimer)
+	w.gauges = make(map[string]float64)
+	w.Unlock()
+	var lines []string
+	for key, count := range counters {
+		lines = append(lines, w.line(key, strconv.FormatInt(count, 10), "c", 1))
+	}
+	for key, timer := range timers {
+		rate := float64(len(timer.samples)) / float64(timer.count)
+		for _, sample := range timer.samples {
+			lines = append(lines, w.line(key, strconv.FormatFloat(sample, 'f', -1, 64), "ms", rate))
+		}
+	}
+	for key, value := range gauges {
+		lines = append(lines, w.line(key, strconv.FormatFloat(value, 'f', -1, 64), "g", 1))
+	}
+	sort.Strings(lines)
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > w.MaxPacketSize {
+			w.send(packet.Bytes())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		w.send(packet.Bytes())
+	}
+}
+
+func (w *StatsdWriter) send(packet []byte) {
+	if _, err := w.conn.Write(packet); err != nil {
+		log.Println("statsd write", err)
+		w.metricstatus.WithLabelValues("failed").Inc()
+		return
+	}
+	w.metricstatus.WithLabelValues("sent").Inc()
+}
+
+func (w *StatsdWriter) flushLoop() {
+	ticker := time.NewTicker(time.Duration(w.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.exitChan:
+			return
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"text/template"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// config
+// {
+// "Mode":"json",
+// "Template":"{{.Host}} {{.Status}} {{.RequestTime}}",
+// "Fields":"Host,Status,RequestTime",
+// "Type":"stdout"
+// }
+// Mode json, pretty-json or template, template is executed with each msg
+// Fields keep only listed fields if set
+
+// StdoutWriter print msg to stdout
+type StdoutWriter struct {
+	sync.Mutex
+	Mode         string
+	Fields       []string
+	template     *template.Template
+	writer       *bufio.Writer
+	exitChan     chan int
+	metricstatus *prometheus.CounterVec
+}
+
+// NewStdoutWriter create StdoutWriter
+func NewStdoutWriter(config map[string]string) (*StdoutWriter, error) {
+	w := &StdoutWriter{Mode: config["Mode"]}
+	switch w.Mode {
+	case "pretty-json":
+	case "template":
+		var err error
+		w.template, err = template.New("stdout").Parse(config["Template"])
+		if err != nil {
+			return w, err
+		}
+	default:
+		w.Mode = "json"
+	}
+	w.Fields = splitKeys(config["Fields"])
+	w.writer = bufio.NewWriter(os.Stdout)
+	w.exitChan = make(chan int)
+	w.metricstatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "lazy_output",
+			Name:      fmt.Sprintf("stdout_writer_%s", config["Taskname"]),
+			Help:      "stdout writer status.",
+		},
+		[]string{"method"},
+	)
+	// Register status
+	prometheus.Register(w.metricstatus)
+	return w, nil
+}
+
+// Stop close all
+func (w *StdoutWriter) Stop() {
+	close(w.exitChan)
+	w.Lock()
+	w.writer.Flush()
+	w.Unlock()
+	prometheus.Unregister(w.metricstatus)
+}
+
+// Start run writer
+func (w *StdoutWriter) Start(dataChan chan *map[string]interface{}) {
+	for {
+		select {
+		case <-w.exitChan:
+			return
+		case logmsg := <-dataChan:
+			if len(w.Fields) > 0 {
+				msg := make(map[string]interface{})
+				for _, k := range w.Fields {
+					if value, ok := LookupValue(logmsg, k); ok {
+						msg[k] = value
+					}
+				}
+				logmsg = &msg
+			}
+			if err := w.print(logmsg); err != nil {
+				log.Println("stdout writer", err)
+				w.metricstatus.WithLabelValues("failed").Inc()
+				break
+			}
+			w.metricstatus.WithLabelValues("printed").Inc()
+		}
+	}
+}
+
+func (w *StdoutWriter) print(msg *map[string]interface{}) error {
+	w.Lock()
+	defer w.Unlock()
+	var err error
+	switch w.Mode {
+	case "template":
+		err = w.template.Execute(w.writer, msg)
+		if err == nil {
+			err = w.writer.WriteByte('\n')
+		}
+	case "pretty-json":
+		encoder := json.NewEncoder(w.writer)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(msg)
+	default:
+		err = json.NewEncoder(w.writer).Encode(msg)
+	}
+	if err != nil {
+		return err
+	}
+	return w.writer.Flush()
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// config
+// {
+// "Address":"siem.example.com:6514",
+// "Protocol":"tls",
+// "Format":"rfc5424",
+// "Framing":"octet-counting",
+// "MTU":"1400",
+// "Facility":"1",
+// "Severity":"5",
+// "AppName":"lazy",
+// "HostnameField":"hostname",
+// "AppField":"tag",
+// "MessageField":"content",
+// "MatchField":"tag_content_RegexpCheck",
+// "MatchValue":"critical",
+// "BufferSize":"10000",
+// "Type":"syslog"
+// }
+// Protocol udp, tcp or tls, tls use TLSCAFile/TLSCertFile/TLSKeyFile
+// Format rfc5424 or rfc3164, Framing octet-counting or non-transparent for tcp/tls
+// priority/facility/severity/timestamp fields set by rfc3164 parser are used if exist
+// msg failed to send is buffered (BufferSize) and resent in order, writes are skipped
+// while SinkGuard circuit is open
+
+// SyslogWriter forward msg as syslog
+type SyslogWriter struct {
+	sync.Mutex
+	Address       string
+	Protocol      string
+	Format        string
+	Framing       string
+	MTU           int
+	Facility      int
+	Severity      int
+	AppName       string
+	Hostname      string
+	HostnameField string
+	AppField      string
+	MessageField  string
+	MatchField    string
+	MatchValue    string
+	BufferSize    int
+	tlsConfig     *tls.Config
+	conn          net.Conn
+	lastDial      time.Time
+	buffer        [][]byte
+	guard         *SinkGuard
+	wg            sinkWaitGroup
+	exitChan      chan int
+	metricstatus  *prometheus.CounterVec
+}
+
+// NewSyslogWriter create SyslogWriter
+func NewSyslogWriter(config map[string]string) (*SyslogWriter, error) {
+	w := &SyslogWriter{
+		Address:       config["Address"],
+		Protocol:      config["Protocol"],
+		Format:        config["Format"],
+		Framing:       config["Framing"],
+		AppName:       config["AppName"],
+		HostnameField: config["HostnameField"],
+		AppField:      config["AppField"],
+		MessageField:  config["MessageField"],
+		MatchField:    config["MatchField"],
+		MatchValue:    config["MatchValue"],
+	}
+	if len(w.Address) == 0 {
+		return w, fmt.Errorf("no syslog address")
+	}
+	switch w.Protocol {
+	case "tcp", "udp":
+	case "tls":
+		var err error
+		w.tlsConfig, err = NewTLSConfig(config)
+		if err != nil {
+			return w, err
+		}
+	default:
+		w.Protocol = "udp"
+	}
+	if w.Format != "rfc3164" {
+		w.Format = "rfc5424"
+	}
+	if w.Framing != "non-transparent" {
+		w.Framing = "octet-counting"
+	}
+	var err error
+	w.MTU, err = strconv.Atoi(config["MTU"])
+	if err != nil || w.MTU < 480 {
+		w.MTU = 1400
+	}
+	w.Facility, err = strconv.Atoi(config["Facility"])
+	if err != nil || w.Facility < 0 || w.Facility > 23 {
+		w.Facility = 1
+	}
+	w.Severity, err = strconv.Atoi(config["Severity"])
+	if err != nil || w.Severity < 0 || w.Severity > 7 {
+		w.Severity = 5
+	}
+	if len(w.AppName) == 0 {
+		w.AppName = "lazy"
+	}
+	if len(w.HostnameField) == 0 {
+		w.HostnameField = "hostname"
+	}
+	if len(w.AppField) == 0 {
+		w.AppField = "tag"
+	}
+	if len(w.MessageField) == 0 {
+		w.MessageField = "content"
+	}
+	w.BufferSize, err = strconv.Atoi(config["BufferSize"])
+	if err != nil || w.BufferSize < 1 {
+		w.BufferSize = 10000
+	}
+	w.Hostname, _ = os.Hostname()
+	w.exitChan = make(chan int)
+	w.metricstatus = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "lazy_output",
+			Name:      fmt.Sprintf("syslog_writer_%s", config["Taskname"]),
+			Help:      "syslog writer status.",
+		},
+		[]string{"method"},
+	)
+	// Register status
+	prometheus.Register(w.metricstatus)
+	w.guard = NewSinkGuard("syslog", config)
+	return w, nil
+}
+
+// Stop close all
+func (w *SyslogWriter) Stop() {
+	close(w.exitChan)
+	w.wg.Wait()
+	w.Lock()
+	w.flushBuffer()
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	if len(w.buffer) > 0 {
+		w.metricstatus.WithLabelValues("dropped").Add(float64(len(w.buffer)))
+	}
+	w.Unlock()
+	w.guard.Close()
+	log.Println("exit syslog writer")
+	prometheus.Unregister(w.metricstatus)
+}
+
+// Start run writer
+func (w *SyslogWriter) Start(dataChan chan *map[string]interface{}) {
+	if !w.wg.Add() {
+		return
+	}
+	defer w.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.exitChan:
+			return
+		case <-ticker.C:
+			w.Lock()
+			w.flushBuffer()
+			w.Unlock()
+		case logmsg := <-dataChan:
+			if len(w.MatchField) > 0 {
+				if value, _ := LookupField(logmsg, w.MatchField); value != w.MatchValue {
+					break
+				}
+			}
+			w.send(w.frame(logmsg))
+		}
+	}
+}
+
+func intField(msg *map[string]interface{}, name string) (int, bool) {
+	value, ok := (*msg)[name]
+	if !ok {
+		return 0, false
+	}
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	case string:
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// syslogToken header fields must be printable ascii without space
+func syslogToken(value string, maxLen int) string {
+	value = strings.Map(func(r rune) rune {
+		if r <= 32 || r >= 127 {
+			return -1
+		}
+		return r
+	}, value)
+	if len(value) == 0 {
+		return "-"
+	}
+	if len(value) > maxLen {
+		value = value[:maxLen]
+	}
+	return value
+}
+
+// frame build syslog message from msg fields
+func (w *SyslogWriter) frame(msg *map[string]interface{}) []byte {
+	priority, ok := intField(msg, "priority")
+	if !ok {
+		facility, ok := intField(msg, "facility")
+		if !ok {
+			facility = w.Facility
+		}
+		severity, ok := intField(msg, "severity")
+		if !ok {
+			severity = w.Severity
+		}
+		priority = facility*8 + severity
+	}
+	ts, ok := (*msg)["timestamp"].(time.Time)
+	if !ok {
+		ts = time.Now()
+	}
+	hostname, ok := LookupField(msg, w.HostnameField)
+	if !ok || len(hostname) == 0 {
+		hostname = w.Hostname
+	}
+	app, ok := LookupField(msg, w.AppField)
+	if !ok || len(app) == 0 {
+		app = w.AppName
+	}
+	content, ok := LookupField(msg, w.MessageField)
+	if !ok {
+		content, _ = LookupField(msg, "rawmsg")
+	}
+	content = strings.TrimRight(content, "\r\n")
+	var frame string
+	if w.Format == "rfc3164" {
+		frame = fmt.Sprintf("<%d>%s %s %s: %s", priority, ts.Format(time.Stamp),
+			syslogToken(hostname, 255), syslogToken(app, 32), content)
+	} else {
+		frame = fmt.Sprintf("<%d>1 %s %s %s - - - %s", priority, ts.Format("2006-01-02T15:04:05.000000Z07:00"),
+			syslogToken(hostname, 255), syslogToken(app, 48), content)
+	}
+	return []byte(frame)
+}
+
+// encode add framing for tcp/tls, truncate to MTU for udp
+func (w *SyslogWriter) encode(frame []byte) []byte {
+	if w.Protocol == "udp" {
+		if len(frame) > w.MTU {
+			n := w.MTU
+			for n > 0 && !utf8.RuneStart(frame[n]) {
+				n--
+			}
+			frame = frame[:n]
+			w.metricstatus.WithLabelValues("truncated").Inc()
+		}
+		return frame
+	}
+	if w.Framing == "non-transparent" {
+		return append(frame, '\n')
+	}
+	return append([]byte(fmt.Sprintf("%d ", len(frame))), frame...)
+}
+
+func (w *SyslogWriter) connect() error {
+	if w.conn != nil {
+		return nil
+	}
+	// limit reconnect to once per second
+	if time.Since(w.lastDial) < time.Second {
+		return fmt.Errorf("waiting to reconnect %s", w.Address)
+	}
+	w.lastDial = time.Now()
+	var err error
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if w.Protocol == "tls" {
+		w.conn, err = tls.DialWithDialer(dialer, "tcp", w.Address, w.tlsConfig)
+	} else {
+		w.conn, err = dialer.Dial(w.Protocol, w.Address)
+	}
+	if err != nil {
+		w.conn = nil
+		log.Println("syslog connect", err)
+		return err
+	}
+	w.metricstatus.WithLabelValues("connected").Inc()
+	return nil
+}
+
+// write send data once through SinkGuard, AttemptTimeout is the write deadline (default 5s)
+func (w *SyslogWriter) write(data []byte) error {
+	return w.guard.Try(func(ctx context.Context) error {
+		if err := w.connect(); err != nil {
+			return err
+		}
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(5 * time.Second)
+		}
+		w.conn.SetWriteDeadline(deadline)
+		if _, err := w.conn.Write(data); err != nil {
+			log.Println("syslog write", err)
+			w.conn.Close()
+			w.conn = nil
+			return err
+		}
+		return nil
+	})
+}
+
+// flushBuffer resend buffered msg in order, must hold lock
+func (w *SyslogWriter) flushBuffer() {
+	for len(w.buffer) > 0 {
+		if err := w.write(w.buffer[0]); err != nil {
+			return
+		}
+		w.buffer = w.buffer[1:]
+		w.metricstatus.WithLabelValues("sent").Inc()
+	}
+}
+
+func (w *SyslogWriter) send(frame []byte) {
+	data := w.encode(frame)
+	w.Lock()
+	defer w.Unlock()
+	w.flushBuffer()
+	if len(w.buffer) == 0 {
+		if err := w.write(data); err == nil {
+			w.metricstatus.WithLabelValues("sent").Inc()
+			return
+		}
+	}
+	if len(w.buffer) >= w.BufferSize {
+		w.buffer = w.buffer[1:]
+		w.metricstatus.WithLabelValues("dropped").Inc()
+	}
+	w.buffer = append(w.buffer, data)
+	w.metricstatus.WithLabelValues("buffered").Inc()
+}
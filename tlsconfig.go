@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// config
+// {
+// "TLSCAFile":"/etc/lazy/ca.pem",
+// "TLSCertFile":"/etc/lazy/client.pem",
+// "TLSKeyFile":"/etc/lazy/client.key",
+// "TLSInsecureSkipVerify":"false"
+// }
+
+// NewTLSConfig create tls.Config from CA, client cert and key files
+func NewTLSConfig(config map[string]string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if len(config["TLSCAFile"]) > 0 {
+		ca, err := ioutil.ReadFile(config["TLSCAFile"])
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("bad ca file %s", config["TLSCAFile"])
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(config["TLSCertFile"]) > 0 {
+		cert, err := tls.LoadX509KeyPair(config["TLSCertFile"], config["TLSKeyFile"])
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config["TLSInsecureSkipVerify"] == "true" {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}